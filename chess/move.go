@@ -0,0 +1,308 @@
+package chess
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Move is a move in a position. Promotion is the kind of the new piece.
+type Move struct {
+	From, To  Square
+	Promotion Piece
+}
+
+// String is the move in UCI notation, e2e4 or e7e8q.
+func (m Move) String() string {
+	s := m.From.String() + m.To.String()
+	if m.Promotion != NoPiece {
+		s += string(m.Promotion.Kind())
+	}
+	return s
+}
+
+var (
+	knightJumps = [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}}
+	kingSteps   = [][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+	rookLines   = [][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+	bishopLines = [][2]int{{1, 1}, {-1, 1}, {-1, -1}, {1, -1}}
+)
+
+// offset is the square df files and dr ranks away from sq, if any.
+func offset(sq Square, df, dr int) (Square, bool) {
+	f, r := sq.File()+df, sq.Rank()+dr
+	if f < 0 || f > 7 || r < 0 || r > 7 {
+		return NoSquare, false
+	}
+	return Square(r*8 + f), true
+}
+
+// castlingSquares are the squares that end castling rights when a piece
+// moves from or to them.
+var castlingSquares = []struct {
+	sq     Square
+	rights int
+}{
+	{0, WhiteQueenSide}, {7, WhiteKingSide}, {4, WhiteKingSide | WhiteQueenSide},
+	{56, BlackQueenSide}, {63, BlackKingSide}, {60, BlackKingSide | BlackQueenSide},
+}
+
+// attacked reports whether a piece of color by attacks sq.
+func (p *Position) attacked(sq Square, by Color) bool {
+	if sq == NoSquare {
+		return false
+	}
+	is := func(s Square, kinds string) bool {
+		piece := p.Board[s]
+		return piece != NoPiece && piece.Color() == by && strings.IndexByte(kinds, byte(piece.Kind())) >= 0
+	}
+	for _, d := range knightJumps {
+		if s, ok := offset(sq, d[0], d[1]); ok && is(s, "n") {
+			return true
+		}
+	}
+	for _, d := range kingSteps {
+		if s, ok := offset(sq, d[0], d[1]); ok && is(s, "k") {
+			return true
+		}
+	}
+	// a pawn of color by attacks sq from the rank behind it
+	dr := -1
+	if by == Black {
+		dr = 1
+	}
+	for _, df := range []int{-1, 1} {
+		if s, ok := offset(sq, df, dr); ok && is(s, "p") {
+			return true
+		}
+	}
+	slide := func(lines [][2]int, kinds string) bool {
+		for _, d := range lines {
+			for s, ok := offset(sq, d[0], d[1]); ok; s, ok = offset(s, d[0], d[1]) {
+				if p.Board[s] != NoPiece {
+					if is(s, kinds) {
+						return true
+					}
+					break
+				}
+			}
+		}
+		return false
+	}
+	return slide(rookLines, "rq") || slide(bishopLines, "bq")
+}
+
+func (p *Position) pseudoMoves() []Move {
+	var moves []Move
+	add := func(from, to Square) {
+		moves = append(moves, Move{From: from, To: to})
+	}
+	for i, piece := range p.Board {
+		from := Square(i)
+		if piece == NoPiece || piece.Color() != p.Turn {
+			continue
+		}
+		switch piece.Kind() {
+		case 'p':
+			p.pawnMoves(from, &moves)
+		case 'n', 'k':
+			steps := knightJumps
+			if piece.Kind() == 'k' {
+				steps = kingSteps
+			}
+			for _, d := range steps {
+				if to, ok := offset(from, d[0], d[1]); ok {
+					if t := p.Board[to]; t == NoPiece || t.Color() != p.Turn {
+						add(from, to)
+					}
+				}
+			}
+		default:
+			var lines [][2]int
+			switch piece.Kind() {
+			case 'r':
+				lines = rookLines
+			case 'b':
+				lines = bishopLines
+			case 'q':
+				lines = append(append(lines, rookLines...), bishopLines...)
+			}
+			for _, d := range lines {
+				for to, ok := offset(from, d[0], d[1]); ok; to, ok = offset(to, d[0], d[1]) {
+					if t := p.Board[to]; t != NoPiece {
+						if t.Color() != p.Turn {
+							add(from, to)
+						}
+						break
+					}
+					add(from, to)
+				}
+			}
+		}
+	}
+	p.castlingMoves(&moves)
+	return moves
+}
+
+func (p *Position) pawnMoves(from Square, moves *[]Move) {
+	dr, start, last := 1, 1, 7
+	if p.Turn == Black {
+		dr, start, last = -1, 6, 0
+	}
+	add := func(to Square) {
+		if to.Rank() == last {
+			for _, k := range "qrbn" {
+				*moves = append(*moves, Move{From: from, To: to, Promotion: Piece(k)})
+			}
+		} else {
+			*moves = append(*moves, Move{From: from, To: to})
+		}
+	}
+	if to, ok := offset(from, 0, dr); ok && p.Board[to] == NoPiece {
+		add(to)
+		if to2, ok := offset(to, 0, dr); ok && from.Rank() == start && p.Board[to2] == NoPiece {
+			add(to2)
+		}
+	}
+	for _, df := range []int{-1, 1} {
+		if to, ok := offset(from, df, dr); ok {
+			if t := p.Board[to]; (t != NoPiece && t.Color() != p.Turn) || to == p.EnPassant {
+				add(to)
+			}
+		}
+	}
+}
+
+func (p *Position) castlingMoves(moves *[]Move) {
+	rights, king, rank := WhiteKingSide|WhiteQueenSide, Piece('K'), 0
+	if p.Turn == Black {
+		rights, king, rank = BlackKingSide|BlackQueenSide, 'k', 56
+	}
+	from := Square(rank + 4)
+	if p.Castling&rights == 0 || p.Board[from] != king || p.attacked(from, 1-p.Turn) {
+		return
+	}
+	empty := func(files ...int) bool {
+		for _, f := range files {
+			if p.Board[rank+f] != NoPiece {
+				return false
+			}
+		}
+		return true
+	}
+	safe := func(files ...int) bool {
+		for _, f := range files {
+			if p.attacked(Square(rank+f), 1-p.Turn) {
+				return false
+			}
+		}
+		return true
+	}
+	if p.Castling&rights&(WhiteKingSide|BlackKingSide) != 0 && empty(5, 6) && safe(5, 6) {
+		*moves = append(*moves, Move{From: from, To: Square(rank + 6)})
+	}
+	if p.Castling&rights&(WhiteQueenSide|BlackQueenSide) != 0 && empty(1, 2, 3) && safe(2, 3) {
+		*moves = append(*moves, Move{From: from, To: Square(rank + 2)})
+	}
+}
+
+func (p *Position) LegalMoves() []Move {
+	var legal []Move
+	for _, m := range p.pseudoMoves() {
+		next := p.Play(m)
+		if !next.attacked(next.king(p.Turn), next.Turn) {
+			legal = append(legal, m)
+		}
+	}
+	return legal
+}
+
+func (p *Position) IsLegal(m Move) bool {
+	for _, l := range p.LegalMoves() {
+		if l == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Position) IsCheckmate() bool {
+	return p.InCheck() && len(p.LegalMoves()) == 0
+}
+
+func (p *Position) IsStalemate() bool {
+	return !p.InCheck() && len(p.LegalMoves()) == 0
+}
+
+// Play returns the position after m. It does not check that m is legal.
+func (p *Position) Play(m Move) *Position {
+	next := *p
+	piece := p.Board[m.From]
+	captured := p.Board[m.To]
+	next.Board[m.From] = NoPiece
+	next.Board[m.To] = piece
+	next.EnPassant = NoSquare
+
+	switch piece.Kind() {
+	case 'p':
+		if m.To == p.EnPassant {
+			next.Board[Square(m.From.Rank()*8+m.To.File())] = NoPiece
+			captured = 'p'
+		}
+		if d := m.To - m.From; d == 16 || d == -16 {
+			next.EnPassant = (m.From + m.To) / 2
+		}
+		if m.Promotion != NoPiece {
+			next.Board[m.To] = m.Promotion.Of(p.Turn)
+		}
+	case 'k':
+		if d := m.To - m.From; d == 2 || d == -2 {
+			rank := Square(m.From.Rank() * 8)
+			rookFrom, rookTo := rank+7, rank+5
+			if d < 0 {
+				rookFrom, rookTo = rank, rank+3
+			}
+			next.Board[rookTo] = next.Board[rookFrom]
+			next.Board[rookFrom] = NoPiece
+		}
+	}
+
+	for _, c := range castlingSquares {
+		if m.From == c.sq || m.To == c.sq {
+			next.Castling &^= c.rights
+		}
+	}
+
+	if piece.Kind() == 'p' || captured != NoPiece {
+		next.HalfMoves = 0
+	} else {
+		next.HalfMoves++
+	}
+	if p.Turn == Black {
+		next.FullMoves++
+	}
+	next.Turn = 1 - p.Turn
+	return &next
+}
+
+// ParseUCI reads a move in UCI notation and checks that it is legal.
+// Castling is the king's move of two squares.
+func (p *Position) ParseUCI(s string) (Move, error) {
+	var m Move
+	var err error
+	if len(s) != 4 && len(s) != 5 {
+		return m, fmt.Errorf("bad uci move '%s'", s)
+	}
+	if m.From, err = ParseSquare(s[0:2]); err != nil {
+		return m, fmt.Errorf("bad uci move '%s'", s)
+	}
+	if m.To, err = ParseSquare(s[2:4]); err != nil {
+		return m, fmt.Errorf("bad uci move '%s'", s)
+	}
+	if len(s) == 5 {
+		m.Promotion = Piece(s[4]).Kind()
+	}
+	if !p.IsLegal(m) {
+		return m, fmt.Errorf("illegal move '%s' in %s", s, p.FEN())
+	}
+	return m, nil
+}
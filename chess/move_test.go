@@ -0,0 +1,105 @@
+package chess
+
+import "testing"
+
+func perft(p *Position, depth int) int {
+	moves := p.LegalMoves()
+	if depth == 1 {
+		return len(moves)
+	}
+	n := 0
+	for _, m := range moves {
+		n += perft(p.Play(m), depth-1)
+	}
+	return n
+}
+
+// The positions and counts are those of the chessprogramming wiki.
+var perftTests = []struct {
+	name   string
+	fen    string
+	counts []int // by depth, from 1
+}{
+	{"start", StartFEN, []int{20, 400, 8902, 197281}},
+	{"kiwipete", "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", []int{48, 2039, 97862}},
+	{"position 3", "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", []int{14, 191, 2812, 43238}},
+	{"position 4", "r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", []int{6, 264, 9467}},
+	{"position 4 mirrored", "r2q1rk1/pP1p2pp/Q4n2/bbp1p3/Np6/1B3NBn/pPPP1PPP/R3K2R b KQ - 0 1", []int{6, 264, 9467}},
+	{"position 5", "rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8", []int{44, 1486, 62379}},
+}
+
+func TestPerft(t *testing.T) {
+	for _, c := range perftTests {
+		p, err := ParseFEN(c.fen)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		for i, want := range c.counts {
+			depth := i + 1
+			if testing.Short() && want > 10000 {
+				break
+			}
+			if got := perft(p, depth); got != want {
+				t.Errorf("%s: perft(%d) = %d, want %d", c.name, depth, got, want)
+			}
+		}
+	}
+}
+
+func TestPlay(t *testing.T) {
+	for _, c := range []struct {
+		fen, move, want string
+	}{
+		{StartFEN, "e2e4", "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1"},
+		{"rnbqkbnr/ppp1p1pp/8/3pPp2/8/8/PPPP1PPP/RNBQKBNR w KQkq f6 0 3", "e5f6",
+			"rnbqkbnr/ppp1p1pp/5P2/3p4/8/8/PPPP1PPP/RNBQKBNR b KQkq - 0 3"},
+		{"r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 5 20", "e1g1", "r3k2r/8/8/8/8/8/8/R4RK1 b kq - 6 20"},
+		{"r3k2r/8/8/8/8/8/8/R3K2R b KQkq - 5 20", "e8c8", "2kr3r/8/8/8/8/8/8/R3K2R w KQ - 6 21"},
+		{"r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "a1a8", "R3k2r/8/8/8/8/8/8/4K2R b Kk - 0 1"},
+		{"4k3/1P6/8/8/8/8/8/4K3 w - - 0 1", "b7b8n", "1N2k3/8/8/8/8/8/8/4K3 b - - 0 1"},
+	} {
+		p, err := ParseFEN(c.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := p.ParseUCI(c.move)
+		if err != nil {
+			t.Errorf("%s: %v", c.fen, err)
+			continue
+		}
+		if got := p.Play(m).FEN(); got != c.want {
+			t.Errorf("%s after %s is %s, want %s", c.fen, c.move, got, c.want)
+		}
+	}
+}
+
+func TestParseUCI(t *testing.T) {
+	p := StartPosition()
+	for _, bad := range []string{"e2e5", "e1g1", "e2", "e2e4q", "i2i4", "e7e5"} {
+		if _, err := p.ParseUCI(bad); err == nil {
+			t.Errorf("ParseUCI(%s) in the start position did not fail", bad)
+		}
+	}
+}
+
+func TestGameEnd(t *testing.T) {
+	for _, c := range []struct {
+		fen                         string
+		mate, stalemate, inadequate bool
+	}{
+		{"rnb1kbnr/pppp1ppp/8/4p3/6Pq/5P2/PPPPP2P/RNBQKBNR w KQkq - 1 3", true, false, false},
+		{"7k/5Q2/6K1/8/8/8/8/8 b - - 0 1", false, true, false},
+		{"8/8/4k3/8/8/3BK3/8/8 w - - 0 1", false, false, true},
+		{"8/8/4k3/8/2b5/3BK3/8/8 w - - 0 1", false, false, true},
+		{"8/8/4k3/8/3b4/3BK3/8/8 w - - 0 1", false, false, false},
+		{"8/8/4k3/8/8/3NK3/8/4n3 w - - 0 1", false, false, false},
+	} {
+		p, err := ParseFEN(c.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.IsCheckmate() != c.mate || p.IsStalemate() != c.stalemate || p.InsufficientMaterial() != c.inadequate {
+			t.Errorf("%s: checkmate %v stalemate %v insufficient material %v", c.fen, p.IsCheckmate(), p.IsStalemate(), p.InsufficientMaterial())
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package chess
+
+import "testing"
+
+// The keys are those of the examples of the Polyglot book format.
+func TestPolyglotKey(t *testing.T) {
+	for _, c := range []struct {
+		moves []string
+		key   uint64
+	}{
+		{nil, 0x463b96181691fc9c},
+		{[]string{"e2e4"}, 0x823c9b50fd114196},
+		{[]string{"e2e4", "d7d5"}, 0x0756b94461c50fb0},
+		{[]string{"e2e4", "d7d5", "e4e5"}, 0x662fafb965db29d4},
+		{[]string{"e2e4", "d7d5", "e4e5", "f7f5"}, 0x22a48b5a8e47ff78},
+		{[]string{"e2e4", "d7d5", "e4e5", "f7f5", "e1e2"}, 0x652a607ca3f242c1},
+		{[]string{"e2e4", "d7d5", "e4e5", "f7f5", "e1e2", "e8f7"}, 0x00fdd303c946bdd9},
+		{[]string{"a2a4", "b7b5", "h2h4", "b5b4", "c2c4"}, 0x3c8123ea7b067637},
+		{[]string{"a2a4", "b7b5", "h2h4", "b5b4", "c2c4", "b4c3", "a1a3"}, 0x5c3f9b829b279560},
+	} {
+		p := StartPosition()
+		for _, uci := range c.moves {
+			m, err := p.ParseUCI(uci)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p = p.Play(m)
+		}
+		if got := p.PolyglotKey(); got != c.key {
+			t.Errorf("key after %v is %016x, want %016x", c.moves, got, c.key)
+		}
+	}
+}
+
+func TestPolyglotMove(t *testing.T) {
+	p, err := ParseFEN("r3k2r/1P6/8/8/8/8/8/R3K2R w KQkq - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uci := range []string{"e1g1", "e1c1", "b7b8q", "b7a8n", "a1a8"} {
+		m, err := p.ParseUCI(uci)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := p.ParsePolyglotMove(p.PolyglotMove(m))
+		if err != nil || back != m {
+			t.Errorf("%s is read back as %s, %v", uci, back, err)
+		}
+	}
+	// castling is the king taking its rook: e1h1 is 0x0107
+	if v := p.PolyglotMove(Move{From: 4, To: 6}); v != 0x0107 {
+		t.Errorf("O-O is %04x, want 0107", v)
+	}
+}
@@ -0,0 +1,320 @@
+// Package chess is the board logic shared by the chess tools in this
+// repository: FEN, legal moves and the UCI and SAN move notations.
+// gochess parses PGN for us but needs its own board for everything else.
+package chess
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Color int
+
+const (
+	White Color = iota
+	Black
+)
+
+func (c Color) String() string {
+	if c == White {
+		return "w"
+	}
+	return "b"
+}
+
+// Piece is the FEN letter of a piece, uppercase for white. The zero
+// Piece is an empty square.
+type Piece byte
+
+const NoPiece Piece = 0
+
+func (p Piece) Color() Color {
+	if p >= 'a' {
+		return Black
+	}
+	return White
+}
+
+// Kind is the lowercase letter of the piece, the same for both colors.
+func (p Piece) Kind() Piece {
+	if p != NoPiece && p < 'a' {
+		return p + 'a' - 'A'
+	}
+	return p
+}
+
+func (p Piece) Of(c Color) Piece {
+	if c == White {
+		return p.Kind() - 'a' + 'A'
+	}
+	return p.Kind()
+}
+
+// Square is 0 for a1, 1 for b1 up to 63 for h8.
+type Square int
+
+const NoSquare Square = -1
+
+func (sq Square) File() int { return int(sq) % 8 }
+func (sq Square) Rank() int { return int(sq) / 8 }
+
+func (sq Square) String() string {
+	if sq == NoSquare {
+		return "-"
+	}
+	return string([]byte{byte('a' + sq.File()), byte('1' + sq.Rank())})
+}
+
+func ParseSquare(s string) (Square, error) {
+	if len(s) != 2 || s[0] < 'a' || s[0] > 'h' || s[1] < '1' || s[1] > '8' {
+		return NoSquare, fmt.Errorf("bad square '%s'", s)
+	}
+	return Square(int(s[1]-'1')*8 + int(s[0]-'a')), nil
+}
+
+// Castling rights
+const (
+	WhiteKingSide = 1 << iota
+	WhiteQueenSide
+	BlackKingSide
+	BlackQueenSide
+)
+
+type Position struct {
+	Board     [64]Piece
+	Turn      Color
+	Castling  int
+	EnPassant Square
+	HalfMoves int
+	FullMoves int
+}
+
+const StartFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
+func StartPosition() *Position {
+	p, _ := ParseFEN(StartFEN)
+	return p
+}
+
+// ParseFEN reads a position and checks that it is one that can be played
+// from: one king each, no pawns on the back ranks, the side not to move
+// not in check and castling and en passant rights that agree with the
+// board. The move counters may be missing.
+func ParseFEN(fen string) (*Position, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return nil, fmt.Errorf("fen '%s' needs 4 to 6 fields", fen)
+	}
+	p := &Position{EnPassant: NoSquare, FullMoves: 1}
+
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return nil, fmt.Errorf("fen '%s' has %d ranks", fen, len(ranks))
+	}
+	for i, rank := range ranks {
+		f := 0
+		for _, c := range rank {
+			switch {
+			case c >= '1' && c <= '8':
+				f += int(c - '0')
+			case strings.ContainsRune("PNBRQKpnbrqk", c):
+				if f < 8 {
+					p.Board[(7-i)*8+f] = Piece(c)
+				}
+				f++
+			default:
+				return nil, fmt.Errorf("fen '%s' has bad piece '%c'", fen, c)
+			}
+		}
+		if f != 8 {
+			return nil, fmt.Errorf("fen '%s' has %d squares in rank %d", fen, f, 8-i)
+		}
+	}
+
+	switch fields[1] {
+	case "w":
+		p.Turn = White
+	case "b":
+		p.Turn = Black
+	default:
+		return nil, fmt.Errorf("fen '%s' has bad side to move '%s'", fen, fields[1])
+	}
+
+	if fields[2] != "-" {
+		for _, c := range fields[2] {
+			i := strings.IndexRune("KQkq", c)
+			if i < 0 {
+				return nil, fmt.Errorf("fen '%s' has bad castling '%s'", fen, fields[2])
+			}
+			p.Castling |= 1 << uint(i)
+		}
+	}
+
+	if fields[3] != "-" {
+		sq, err := ParseSquare(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("fen '%s' has bad en passant square '%s'", fen, fields[3])
+		}
+		p.EnPassant = sq
+	}
+
+	if len(fields) > 4 {
+		n, err := strconv.Atoi(fields[4])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("fen '%s' has bad halfmove clock '%s'", fen, fields[4])
+		}
+		p.HalfMoves = n
+	}
+	if len(fields) > 5 {
+		n, err := strconv.Atoi(fields[5])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("fen '%s' has bad move number '%s'", fen, fields[5])
+		}
+		p.FullMoves = n
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("fen '%s': %v", fen, err)
+	}
+	return p, nil
+}
+
+func (p *Position) validate() error {
+	var kings [2]int
+	for sq, piece := range p.Board {
+		switch piece {
+		case 'K':
+			kings[White]++
+		case 'k':
+			kings[Black]++
+		case 'P', 'p':
+			if r := Square(sq).Rank(); r == 0 || r == 7 {
+				return errors.New("pawn on the first or last rank")
+			}
+		}
+	}
+	if kings[White] != 1 || kings[Black] != 1 {
+		return errors.New("each side needs exactly one king")
+	}
+	if p.attacked(p.king(1-p.Turn), p.Turn) {
+		return errors.New("the side not to move is in check")
+	}
+
+	for _, c := range []struct {
+		right      int
+		king, rook Square
+		pk, pr     Piece
+	}{
+		{WhiteKingSide, 4, 7, 'K', 'R'},
+		{WhiteQueenSide, 4, 0, 'K', 'R'},
+		{BlackKingSide, 60, 63, 'k', 'r'},
+		{BlackQueenSide, 60, 56, 'k', 'r'},
+	} {
+		if p.Castling&c.right != 0 && (p.Board[c.king] != c.pk || p.Board[c.rook] != c.pr) {
+			return errors.New("castling rights without king and rook in place")
+		}
+	}
+
+	if ep := p.EnPassant; ep != NoSquare {
+		// the pawn that just moved two squares must be in front of ep
+		rank, dir, pawn := 5, -8, Piece('p')
+		if p.Turn == Black {
+			rank, dir, pawn = 2, 8, 'P'
+		}
+		if ep.Rank() != rank || p.Board[ep] != NoPiece || p.Board[ep+Square(dir)] != pawn {
+			return fmt.Errorf("bad en passant square %s", ep)
+		}
+	}
+	return nil
+}
+
+func (p *Position) FEN() string {
+	var b strings.Builder
+	for r := 7; r >= 0; r-- {
+		empty := 0
+		for f := 0; f < 8; f++ {
+			piece := p.Board[r*8+f]
+			if piece == NoPiece {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				b.WriteByte(byte('0' + empty))
+				empty = 0
+			}
+			b.WriteByte(byte(piece))
+		}
+		if empty > 0 {
+			b.WriteByte(byte('0' + empty))
+		}
+		if r > 0 {
+			b.WriteByte('/')
+		}
+	}
+	castling := ""
+	for i, c := range "KQkq" {
+		if p.Castling&(1<<uint(i)) != 0 {
+			castling += string(c)
+		}
+	}
+	if castling == "" {
+		castling = "-"
+	}
+	return fmt.Sprintf("%s %s %s %s %d %d", b.String(), p.Turn, castling, p.EnPassant, p.HalfMoves, p.FullMoves)
+}
+
+func (p *Position) king(c Color) Square {
+	k := Piece('k').Of(c)
+	for sq, piece := range p.Board {
+		if piece == k {
+			return Square(sq)
+		}
+	}
+	return NoSquare
+}
+
+func (p *Position) InCheck() bool {
+	return p.attacked(p.king(p.Turn), 1-p.Turn)
+}
+
+// Key identifies the position for repetitions: the FEN without the move
+// counters and with the en passant square only if a pawn can capture
+// there.
+func (p *Position) Key() string {
+	q := *p
+	if q.EnPassant != NoSquare {
+		q.EnPassant = NoSquare
+		for _, m := range p.LegalMoves() {
+			if m.To == p.EnPassant && p.Board[m.From].Kind() == 'p' {
+				q.EnPassant = p.EnPassant
+			}
+		}
+	}
+	return strings.Join(strings.Fields(q.FEN())[:4], " ")
+}
+
+// InsufficientMaterial reports whether neither side can mate: only kings
+// and one minor piece, or bishops all on squares of one color.
+func (p *Position) InsufficientMaterial() bool {
+	minors := 0
+	var bishopSquares [2]int
+	for sq, piece := range p.Board {
+		switch piece.Kind() {
+		case 'p', 'r', 'q':
+			return false
+		case 'n':
+			minors++
+		case 'b':
+			minors++
+			s := Square(sq)
+			bishopSquares[(s.File()+s.Rank())%2]++
+		}
+	}
+	if minors <= 1 {
+		return true
+	}
+	bishops := bishopSquares[0] + bishopSquares[1]
+	return bishops == minors && (bishopSquares[0] == 0 || bishopSquares[1] == 0)
+}
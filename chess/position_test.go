@@ -0,0 +1,79 @@
+package chess
+
+import "testing"
+
+func TestFENRoundTrip(t *testing.T) {
+	for _, fen := range []string{
+		StartFEN,
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"rnbqkbnr/ppp1pppp/8/3p4/4P3/8/PPPP1PPP/RNBQKBNR w KQkq d6 0 2",
+		"rnbqkbnr/pppp1ppp/8/8/3pP3/8/PPP2PPP/RNBQKBNR b Kq e3 0 3",
+		"8/8/8/8/8/8/8/k6K b - - 99 150",
+	} {
+		p, err := ParseFEN(fen)
+		if err != nil {
+			t.Errorf("ParseFEN(%s): %v", fen, err)
+			continue
+		}
+		if got := p.FEN(); got != fen {
+			t.Errorf("ParseFEN(%s).FEN() = %s", fen, got)
+		}
+	}
+}
+
+func TestParseFENCounters(t *testing.T) {
+	p, err := ParseFEN("4k3/8/8/8/8/8/8/4K3 b - -")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.HalfMoves != 0 || p.FullMoves != 1 || p.Turn != Black {
+		t.Errorf("FEN without counters is %s", p.FEN())
+	}
+}
+
+func TestParseFENErrors(t *testing.T) {
+	for _, fen := range []string{
+		"",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP w KQkq - 0 1",
+		"rnbqkbnr/pppppppp/9/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+		"rnbqkbnr/ppppxppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR x KQkq - 0 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkx - 0 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - -1 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 0",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1 extra",
+		"8/8/8/8/8/8/8/8 w - - 0 1",
+		"4k3/8/8/8/8/8/8/4KK2 w - - 0 1",
+		"P3k3/8/8/8/8/8/8/4K3 w - - 0 1",
+		"4k3/8/8/8/8/8/8/4K2r b - - 0 1",
+		"4k3/8/8/8/8/8/8/4K3 w K - 0 1",
+		"1r2k3/8/8/8/8/8/8/4K3 w q - 0 1",
+		"4k3/8/8/8/4P3/8/8/4K3 b - e4 0 1",
+		"4k3/8/8/8/8/8/8/4K3 b - e3 0 1",
+		"4k3/8/8/8/4P3/8/8/4K3 w - e3 0 1",
+	} {
+		if _, err := ParseFEN(fen); err == nil {
+			t.Errorf("ParseFEN(%q) did not fail", fen)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	for _, c := range []struct {
+		fen, key string
+	}{
+		// no black pawn can take on e3
+		{"rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq -"},
+		{"rnbqkbnr/ppp1pppp/8/8/3pP3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 3", "rnbqkbnr/ppp1pppp/8/8/3pP3/8/PPPP1PPP/RNBQKBNR b KQkq e3"},
+	} {
+		p, err := ParseFEN(c.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Key(); got != c.key {
+			t.Errorf("Key(%s) = %s, want %s", c.fen, got, c.key)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package chess
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SevenTagRoster are the tags every PGN game has, in the order they are
+// written.
+var SevenTagRoster = []string{"Event", "Site", "Date", "Round", "White", "Black", "Result"}
+
+// SAN writes a legal move in standard algebraic notation, with + or #
+// if it gives check or mate.
+func (p *Position) SAN(m Move) string {
+	piece := p.Board[m.From]
+	var san string
+	switch {
+	case piece.Kind() == 'k' && m.To-m.From == 2:
+		san = "O-O"
+	case piece.Kind() == 'k' && m.From-m.To == 2:
+		san = "O-O-O"
+	case piece.Kind() == 'p':
+		if m.From.File() != m.To.File() {
+			san = m.From.String()[:1] + "x"
+		}
+		san += m.To.String()
+		if m.Promotion != NoPiece {
+			san += "=" + strings.ToUpper(string(m.Promotion.Kind()))
+		}
+	default:
+		san = strings.ToUpper(string(piece.Kind()))
+		// disambiguate from other pieces of the same kind going to m.To
+		var sameFile, sameRank, other bool
+		for _, l := range p.LegalMoves() {
+			if l.To == m.To && l.From != m.From && p.Board[l.From] == piece {
+				other = true
+				sameFile = sameFile || l.From.File() == m.From.File()
+				sameRank = sameRank || l.From.Rank() == m.From.Rank()
+			}
+		}
+		switch {
+		case other && !sameFile:
+			san += m.From.String()[:1]
+		case other && !sameRank:
+			san += m.From.String()[1:]
+		case other:
+			san += m.From.String()
+		}
+		if p.Board[m.To] != NoPiece {
+			san += "x"
+		}
+		san += m.To.String()
+	}
+
+	next := p.Play(m)
+	if next.InCheck() {
+		if len(next.LegalMoves()) == 0 {
+			san += "#"
+		} else {
+			san += "+"
+		}
+	}
+	return san
+}
+
+// ParseSAN reads a move in standard algebraic notation. It is lenient
+// about check marks, annotations and redundant disambiguation.
+func (p *Position) ParseSAN(san string) (Move, error) {
+	s := strings.TrimRight(san, "+#!?")
+	s = strings.Replace(s, "0", "O", -1)
+	legal := p.LegalMoves()
+
+	if s == "O-O" || s == "O-O-O" {
+		k := p.king(p.Turn)
+		for _, m := range legal {
+			if m.From == k && ((s == "O-O" && m.To-m.From == 2) || (s == "O-O-O" && m.From-m.To == 2)) {
+				return m, nil
+			}
+		}
+		return Move{}, fmt.Errorf("illegal move '%s' in %s", san, p.FEN())
+	}
+
+	var promotion Piece
+	if i := strings.IndexByte(s, '='); i >= 0 && i+1 < len(s) {
+		promotion = Piece(s[i+1]).Kind()
+		s = s[:i]
+	} else if n := len(s); n > 2 && strings.IndexByte("QRBN", s[n-1]) >= 0 && s[n-2] >= '1' && s[n-2] <= '8' {
+		promotion = Piece(s[n-1]).Kind()
+		s = s[:n-1]
+	}
+
+	kind := Piece('p')
+	if len(s) > 0 && strings.IndexByte("KQRBNP", s[0]) >= 0 {
+		kind = Piece(s[0]).Kind()
+		s = s[1:]
+	}
+	takes := strings.Contains(s, "x")
+	s = strings.Replace(s, "x", "", 1)
+	s = strings.Replace(s, "-", "", 1)
+	if len(s) < 2 {
+		return Move{}, fmt.Errorf("bad move '%s'", san)
+	}
+	to, err := ParseSquare(s[len(s)-2:])
+	if err != nil {
+		return Move{}, fmt.Errorf("bad move '%s'", san)
+	}
+	from := s[:len(s)-2]
+
+	var found []Move
+	for _, m := range legal {
+		if m.To != to || m.Promotion != promotion || p.Board[m.From].Kind() != kind {
+			continue
+		}
+		if from != "" && !strings.HasPrefix(m.From.String(), from) && !strings.HasSuffix(m.From.String(), from) {
+			continue
+		}
+		// a pawn moves along its file unless it takes, when SAN names the file
+		if capture := m.From.File() != m.To.File(); kind == 'p' && (capture != (from != "") || takes && !capture) {
+			continue
+		}
+		found = append(found, m)
+	}
+	switch len(found) {
+	case 0:
+		return Move{}, fmt.Errorf("illegal move '%s' in %s", san, p.FEN())
+	case 1:
+		return found[0], nil
+	}
+	return Move{}, fmt.Errorf("ambiguous move '%s' in %s", san, p.FEN())
+}
@@ -0,0 +1,89 @@
+package chess
+
+import "testing"
+
+var sanTests = []struct {
+	fen  string
+	uci  string
+	san  string   // as SAN writes it
+	also []string // other ways ParseSAN reads it
+}{
+	{StartFEN, "e2e4", "e4", nil},
+	{StartFEN, "g1f3", "Nf3", []string{"Ngf3", "Ng1f3", "Ng1-f3"}},
+	// castling, with check and mate
+	{"r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "e1g1", "O-O", []string{"0-0"}},
+	{"r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "e1c1", "O-O-O", []string{"0-0-0"}},
+	{"r3k2r/8/8/8/8/8/8/R3K2R b KQkq - 0 1", "e8c8", "O-O-O", nil},
+	{"5k2/8/8/8/8/8/8/4K2R w K - 0 1", "e1g1", "O-O+", []string{"O-O"}},
+	{"8/8/8/8/8/8/7R/k3K2R w K - 0 1", "e1g1", "O-O#", nil},
+	// promotion
+	{"4k3/1P6/8/8/8/8/8/4K3 w - - 0 1", "b7b8q", "b8=Q+", []string{"b8Q", "b8=Q"}},
+	{"4k3/1P6/8/8/8/8/8/4K3 w - - 0 1", "b7b8n", "b8=N", []string{"b8N"}},
+	{"2r1k3/1P6/8/8/8/8/8/4K3 w - - 0 1", "b7c8r", "bxc8=R+", []string{"bxc8R", "bc8=R"}},
+	{"4k3/8/8/8/8/8/6p1/4K2R b - - 0 1", "g2h1q", "gxh1=Q+", nil},
+	// en passant
+	{"rnbqkbnr/ppp1p1pp/8/3pPp2/8/8/PPPP1PPP/RNBQKBNR w KQkq f6 0 3", "e5f6", "exf6", []string{"ef6"}},
+	{"rnbqkbnr/ppp1pppp/8/8/3pP3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 3", "d4e3", "dxe3", nil},
+	// disambiguation by file, rank and both
+	{"4k3/8/8/8/8/8/4K3/R6R w - - 0 1", "a1d1", "Rad1", []string{"Ra1d1"}},
+	{"4k3/8/8/R7/8/8/8/R3K3 w - - 0 1", "a1a3", "R1a3", nil},
+	{"k7/8/8/8/8/2Q1Q3/8/2Q1K3 w - - 0 1", "c3d2", "Qc3d2", nil},
+	{"k7/8/8/8/8/2Q1Q3/8/2Q1K3 w - - 0 1", "e3d2", "Qed2", nil},
+	// a pinned knight does not make the other one ambiguous
+	{"4k3/4r3/8/8/8/1N6/4N3/4K3 w - - 0 1", "b3d4", "Nd4", nil},
+	// captures
+	{"4k3/8/8/3p4/4P3/8/8/4K3 w - - 0 1", "e4d5", "exd5", nil},
+	{"4k3/8/8/3p4/8/8/8/3RK3 w - - 0 1", "d1d5", "Rxd5", []string{"Rd5"}},
+	{"rnbqkbnr/pppp1ppp/8/4p3/6P1/5P2/PPPPP2P/RNBQKBNR b KQkq - 0 2", "d8h4", "Qh4#", nil},
+}
+
+func TestSAN(t *testing.T) {
+	for _, c := range sanTests {
+		p, err := ParseFEN(c.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := p.ParseUCI(c.uci)
+		if err != nil {
+			t.Fatalf("%s: %v", c.fen, err)
+		}
+		if got := p.SAN(m); got != c.san {
+			t.Errorf("%s: SAN(%s) = %s, want %s", c.fen, c.uci, got, c.san)
+		}
+		for _, san := range append([]string{c.san}, c.also...) {
+			got, err := p.ParseSAN(san)
+			if err != nil {
+				t.Errorf("%s: ParseSAN(%s): %v", c.fen, san, err)
+			} else if got != m {
+				t.Errorf("%s: ParseSAN(%s) = %s, want %s", c.fen, san, got, c.uci)
+			}
+		}
+	}
+}
+
+func TestParseSANErrors(t *testing.T) {
+	for _, c := range []struct {
+		fen string
+		san []string
+	}{
+		{StartFEN, []string{"e5", "Nf4", "O-O", "Ke2", "e", "", "Zf3", "e9", "exd3"}},
+		// two rooks may go to d1 and two knights to d2
+		{"4k3/8/8/8/8/8/4K3/R6R w - - 0 1", []string{"Rd1"}},
+		{"4k3/8/8/8/8/8/4K3/1N3N2 w - - 0 1", []string{"Nd2"}},
+		// a pawn takes only when SAN says so, and from the file it names
+		{"rnbqkbnr/ppp2ppp/8/3pp3/3PP3/8/PPP2PPP/RNBQKBNR w KQkq - 0 3", []string{"d5", "xd5", "e5", "cxd5"}},
+		{"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", []string{"exe4", "xe4", "e2e4x", "de3"}},
+		// the promotion piece must be given
+		{"4k3/1P6/8/8/8/8/8/4K3 w - - 0 1", []string{"b8", "b8=K", "b8=P"}},
+	} {
+		p, err := ParseFEN(c.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, san := range c.san {
+			if m, err := p.ParseSAN(san); err == nil {
+				t.Errorf("%s: ParseSAN(%s) = %s, want an error", c.fen, san, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// mainLine is the start diagram followed by the diagram after each move
+// of the main line of game, with the move highlighted and in the caption.
+// The marks and arrows of the start are for the start only.
+func mainLine(game *gochess.Game, start *Diagram) ([]*Diagram, error) {
+	frames := []*Diagram{start}
+	p := start.Position
+	for i, ply := range game.Moves.Plies {
+		m, err := p.ParseSAN(ply.SAN)
+		if err != nil {
+			return nil, fmt.Errorf("ply %d: %v", i+1, err)
+		}
+		d := &Diagram{Position: p.Play(m), LastMove: &m, Caption: start.Caption}
+		d.Caption.Move = moveNumber(p) + p.SAN(m)
+		frames = append(frames, d)
+		p = d.Position
+	}
+	return frames, nil
+}
+
+// moveNumber is the number before a move in p, "12." for white and
+// "12..." for black.
+func moveNumber(p *chess.Position) string {
+	if p.Turn == chess.White {
+		return fmt.Sprintf("%d. ", p.FullMoves)
+	}
+	return fmt.Sprintf("%d... ", p.FullMoves)
+}
+
+// Animate writes the frames as an animated gif, each shown for its delay.
+// The gif keeps 1/100s of a second, so the delays are rounded down to it.
+// All frames have the caption lines of the diagrams and the move one.
+func (r *DiagramRenderer) Animate(w io.Writer, frames []*Diagram, delays []time.Duration) error {
+	if len(frames) != len(delays) {
+		return fmt.Errorf("%d frames with %d delays", len(frames), len(delays))
+	}
+	templates := append(r.Captions[:len(r.Captions):len(r.Captions)], r.MoveCaption)
+	var imgs []*image.RGBA
+	for _, d := range frames {
+		captions, err := r.captions(d, templates)
+		if err != nil {
+			return err
+		}
+		img, err := r.Raster(d, captions)
+		if err != nil {
+			return err
+		}
+		imgs = append(imgs, img)
+	}
+
+	pal := framePalette(imgs)
+	anim := &gif.GIF{}
+	for i, img := range imgs {
+		// the nearest colors, dithering spots the squares
+		frame := image.NewPaletted(img.Bounds(), pal)
+		draw.Draw(frame, frame.Bounds(), img, image.ZP, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, int(delays[i]/(10*time.Millisecond)))
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// framePalette is the 256 most used colors of the frames. The squares,
+// the background and the highlights cover most of a diagram and keep
+// their colors; the edges of pieces and letters take the nearest.
+func framePalette(imgs []*image.RGBA) color.Palette {
+	count := make(map[color.RGBA]int)
+	for _, img := range imgs {
+		for i := 0; i+3 < len(img.Pix); i += 4 {
+			count[color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}]++
+		}
+	}
+	colors := make([]color.RGBA, 0, len(count))
+	for c := range count {
+		colors = append(colors, c)
+	}
+	sort.Slice(colors, func(i, j int) bool { return count[colors[i]] > count[colors[j]] })
+	if len(colors) > 256 {
+		colors = colors[:256]
+	}
+	pal := make(color.Palette, len(colors))
+	for i, c := range colors {
+		pal[i] = c
+	}
+	return pal
+}
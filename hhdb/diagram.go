@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/anastasop/oneshot/chess"
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font/gofont/gomono"
+)
+
+type FlipMode int
+
+const (
+	FlipNever FlipMode = iota
+	FlipAlways
+	FlipBlackToMove // show the board from the side to move
+)
+
+func (m FlipMode) String() string {
+	return [...]string{"never", "always", "black"}[m]
+}
+
+func (m *FlipMode) Set(s string) error {
+	for _, mode := range []FlipMode{FlipNever, FlipAlways, FlipBlackToMove} {
+		if s == mode.String() {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("flip must be never, always or black, not '%s'", s)
+}
+
+// Mark colors a square and Arrow joins two, as the [%csl] and [%cal]
+// commands of lichess and ChessBase do.
+type Mark struct {
+	Square chess.Square
+	Color  color.Color
+}
+
+type Arrow struct {
+	From, To chess.Square
+	Color    color.Color
+}
+
+// Caption is what the caption templates are executed with.
+type Caption struct {
+	Tags    map[string]string
+	Author  string
+	Summary string // as in "Win. White to play"
+	Move    string // the move to the position, as in "12... Rd8+", if any
+	Source  string
+	Date    string // as in 1910 or 1910-05-21, ? if unknown
+
+	Variations, TotalVariations int
+}
+
+// Diagram is a position to draw with its decorations.
+type Diagram struct {
+	Position *chess.Position
+	LastMove *chess.Move
+	Marks    []Mark
+	Arrows   []Arrow
+	Caption  Caption
+}
+
+var DefaultCaptions = []string{
+	"{{.Author}}",
+	"{{.Summary}} ({{.Variations}}/{{.TotalVariations}})",
+}
+
+// DiagramRenderer draws diagrams with the caption lines above the board.
+// The raster pieces come from a sprite sheet of 60 pixel squares, black
+// pieces in the first row and white in the second, in the order QKRNBP.
+// The svg pieces are drawn.
+type DiagramRenderer struct {
+	SquareSize  int
+	Format      string // jpeg, png or svg
+	Flip        FlipMode
+	Coordinates bool
+
+	Light, Dark, Background color.Color
+	LastMove                color.Color // drawn over the squares of the last move
+
+	Captions    []*template.Template
+	MoveCaption *template.Template // the last caption line of animations
+
+	pieces map[chess.Piece]draw.Image // scaled to SquareSize
+	font   *truetype.Font
+}
+
+func NewDiagramRenderer(setFile string, squareSize int) (*DiagramRenderer, error) {
+	r := &DiagramRenderer{
+		SquareSize: squareSize,
+		Format:     "jpeg",
+		Light:      color.Gray16{0xffff},
+		Dark:       color.Gray16{0x8f8f},
+		Background: color.RGBA{0xCA, 0xA4, 0x72, 255},
+		LastMove:   color.NRGBA{0xff, 0xd7, 0x00, 0x70},
+		pieces:     make(map[chess.Piece]draw.Image),
+	}
+	if err := r.SetCaptions(DefaultCaptions); err != nil {
+		return nil, err
+	}
+	r.MoveCaption = template.Must(template.New("move").Parse("{{.Move}}"))
+
+	f, err := freetype.ParseFont(gomono.TTF)
+	if err != nil {
+		return nil, err
+	}
+	r.font = f
+
+	data, err := ioutil.ReadFile(setFile)
+	if err != nil {
+		return nil, err
+	}
+	src, err := png.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	set := image.NewRGBA(src.Bounds())
+	draw.Draw(set, set.Bounds(), src, src.Bounds().Min, draw.Src)
+	for i, c := range "qkrnbpQKRNBP" {
+		rect := image.Rect(60*(i%6), 60*(i/6), 60*(i%6)+60, 60*(i/6)+60)
+		img := image.NewRGBA(image.Rect(0, 0, squareSize, squareSize))
+		xdraw.BiLinear.Scale(img, img.Bounds(), set.SubImage(rect), rect, xdraw.Over, nil)
+		r.pieces[chess.Piece(c)] = img
+	}
+	return r, nil
+}
+
+// SetCaptions parses one template per caption line.
+func (r *DiagramRenderer) SetCaptions(lines []string) error {
+	r.Captions = nil
+	for i, line := range lines {
+		t, err := template.New(fmt.Sprint("caption", i+1)).Parse(line)
+		if err != nil {
+			return err
+		}
+		r.Captions = append(r.Captions, t)
+	}
+	return nil
+}
+
+// Ext is the file extension of the format.
+func (r *DiagramRenderer) Ext() string {
+	if r.Format == "jpeg" {
+		return "jpg"
+	}
+	return r.Format
+}
+
+func (r *DiagramRenderer) captions(d *Diagram, templates []*template.Template) ([]string, error) {
+	var lines []string
+	for _, t := range templates {
+		var b strings.Builder
+		if err := t.Execute(&b, d.Caption); err != nil {
+			return nil, err
+		}
+		lines = append(lines, b.String())
+	}
+	return lines, nil
+}
+
+const (
+	fontSize = 8
+	po       = 14 // page offset
+	vs       = 18 // vertical line spacing
+	dpi      = 120.0
+)
+
+// layout is the size of the diagram and where the board starts. The
+// board is square and a half below the top, or lower if there are more
+// than two caption lines, with half a square of margin around it.
+func (r *DiagramRenderer) layout(ncaptions int) (image.Rectangle, image.Point) {
+	sqz := r.SquareSize
+	top := sqz + sqz/2
+	if h := vs*ncaptions + vs/2; h > top {
+		top = h
+	}
+	return image.Rect(0, 0, 9*sqz, top+8*sqz+sqz/2), image.Pt(sqz/2, top)
+}
+
+func (r *DiagramRenderer) flipped(p *chess.Position) bool {
+	return r.Flip == FlipAlways || (r.Flip == FlipBlackToMove && p.Turn == chess.Black)
+}
+
+// square is the top left corner of sq on the board.
+func (r *DiagramRenderer) square(origin image.Point, sq chess.Square, flipped bool) image.Point {
+	f, rank := sq.File(), 7-sq.Rank()
+	if flipped {
+		f, rank = 7-f, 7-rank
+	}
+	return origin.Add(image.Pt(f, rank).Mul(r.SquareSize))
+}
+
+func (r *DiagramRenderer) Render(w io.Writer, d *Diagram) error {
+	captions, err := r.captions(d, r.Captions)
+	if err != nil {
+		return err
+	}
+	switch r.Format {
+	case "jpeg", "png":
+		img, err := r.Raster(d, captions)
+		if err != nil {
+			return err
+		}
+		if r.Format == "png" {
+			return png.Encode(w, img)
+		}
+		return jpeg.Encode(w, img, nil)
+	case "svg":
+		return r.svg(w, d, captions)
+	}
+	return fmt.Errorf("unknown diagram format '%s'", r.Format)
+}
+
+// Raster draws the diagram with the given caption lines.
+func (r *DiagramRenderer) Raster(d *Diagram, captions []string) (*image.RGBA, error) {
+	sqz := r.SquareSize
+	bounds, origin := r.layout(len(captions))
+	flipped := r.flipped(d.Position)
+
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, img.Bounds(), image.NewUniform(r.Background), image.Pt(0, 0), draw.Over)
+
+	colors := [2]image.Image{image.NewUniform(r.Dark), image.NewUniform(r.Light)}
+	highlight := make(map[chess.Square]color.Color)
+	if d.LastMove != nil {
+		highlight[d.LastMove.From] = r.LastMove
+		highlight[d.LastMove.To] = r.LastMove
+	}
+	for _, m := range d.Marks {
+		highlight[m.Square] = m.Color
+	}
+	for sq := chess.Square(0); sq < 64; sq++ {
+		rect := image.Rectangle{Min: r.square(origin, sq, flipped)}
+		rect.Max = rect.Min.Add(image.Pt(sqz, sqz))
+		draw.Draw(img, rect, colors[(sq.File()+sq.Rank())%2], image.ZP, draw.Src)
+		if c, ok := highlight[sq]; ok {
+			draw.Draw(img, rect, image.NewUniform(c), image.ZP, draw.Over)
+		}
+		if piece := d.Position.Board[sq]; piece != chess.NoPiece {
+			draw.Draw(img, rect, r.pieces[piece], image.ZP, draw.Over)
+		}
+	}
+	for _, a := range d.Arrows {
+		center := image.Pt(sqz/2, sqz/2)
+		drawArrow(img, r.square(origin, a.From, flipped).Add(center), r.square(origin, a.To, flipped).Add(center),
+			float64(sqz)/6, a.Color)
+	}
+
+	ctx := freetype.NewContext()
+	ctx.SetFont(r.font)
+	ctx.SetFontSize(fontSize)
+	ctx.SetSrc(image.Black)
+	ctx.SetDst(img)
+	ctx.SetDPI(dpi)
+	ctx.SetClip(img.Bounds())
+	for i, line := range captions {
+		if _, err := ctx.DrawString(line, freetype.Pt(po, (i+1)*vs)); err != nil {
+			return nil, fmt.Errorf("caption '%s': %v", line, err)
+		}
+	}
+
+	if r.Coordinates {
+		ctx.SetFontSize(fontSize * 3 / 4)
+		for i := 0; i < 8; i++ {
+			file, rank := chess.Square(i), chess.Square(8*(7-i))
+			if flipped {
+				file, rank = 7-file, chess.Square(8*i)
+			}
+			if _, err := ctx.DrawString(file.String()[:1], freetype.Pt(origin.X+i*sqz+sqz/2-3, origin.Y+8*sqz+sqz/2-3)); err != nil {
+				return nil, fmt.Errorf("coordinates: %v", err)
+			}
+			if _, err := ctx.DrawString(rank.String()[1:], freetype.Pt(origin.X/2-3, origin.Y+i*sqz+sqz/2+4)); err != nil {
+				return nil, fmt.Errorf("coordinates: %v", err)
+			}
+		}
+	}
+	return img, nil
+}
+
+// drawArrow draws a straight arrow of width w from the center of one
+// square to the center of another.
+func drawArrow(img draw.Image, from, to image.Point, w float64, c color.Color) {
+	dx, dy := float64(to.X-from.X), float64(to.Y-from.Y)
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return
+	}
+	ux, uy := dx/length, dy/length
+	head := 2.5 * w
+
+	bounds := image.Rectangle{Min: from, Max: to}.Canon().Inset(-int(2 * w))
+	mask := image.NewAlpha(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px, py := float64(x-from.X)+0.5, float64(y-from.Y)+0.5
+			t := px*ux + py*uy           // along the arrow
+			n := math.Abs(px*uy - py*ux) // away from it
+			in := false
+			switch {
+			case t < 0 || t > length:
+			case t < length-head:
+				in = n <= w/2
+			default:
+				in = n <= (length-t)/head*w*1.25
+			}
+			if in {
+				mask.SetAlpha(x, y, color.Alpha{0xff})
+			}
+		}
+	}
+	draw.DrawMask(img, bounds, image.NewUniform(c), image.ZP, mask, bounds.Min, draw.Over)
+}
+
+// svg writes the diagram in the layout of the raster one. The pieces are
+// the vector glyphs of svgPieces, so the diagram is sharp at any size.
+func (r *DiagramRenderer) svg(w io.Writer, d *Diagram, captions []string) error {
+	sqz := r.SquareSize
+	bounds, origin := r.layout(len(captions))
+	flipped := r.flipped(d.Position)
+	px := fontSize * dpi / 72
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		bounds.Dx(), bounds.Dy(), bounds.Dx(), bounds.Dy())
+	b.WriteString("<!-- Pieces by Colin M.L. Burnett, under the 3-clause BSD license -->\n")
+	b.WriteString("<defs>\n")
+	// one head per arrow color, as not every viewer fills by context-stroke
+	heads := make(map[string]bool)
+	for _, a := range d.Arrows {
+		if id := svgArrowheadID(a.Color); !heads[id] {
+			heads[id] = true
+			fmt.Fprintf(&b, `<marker id="%s" viewBox="0 0 10 10" refX="5" refY="5" markerWidth="2.5" markerHeight="2.5" orient="auto"><path d="M0,0 L10,5 L0,10 z" %s/></marker>`+"\n",
+				id, svgFill("fill", a.Color))
+		}
+	}
+	used := make(map[chess.Piece]bool)
+	for _, piece := range d.Position.Board {
+		if piece != chess.NoPiece && !used[piece] {
+			used[piece] = true
+			fmt.Fprintf(&b, `<symbol id="%s" viewBox="0 0 45 45">%s</symbol>`+"\n", svgPieceID(piece), svgPieces[piece])
+		}
+	}
+	b.WriteString("</defs>\n")
+
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" %s/>`+"\n", svgFill("fill", r.Background))
+	for i, line := range captions {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="%.1f">%s</text>`+"\n", po, (i+1)*vs, px, svgEscape(line))
+	}
+
+	highlight := make(map[chess.Square]color.Color)
+	if d.LastMove != nil {
+		highlight[d.LastMove.From] = r.LastMove
+		highlight[d.LastMove.To] = r.LastMove
+	}
+	for _, m := range d.Marks {
+		highlight[m.Square] = m.Color
+	}
+	colors := [2]color.Color{r.Dark, r.Light}
+	for sq := chess.Square(0); sq < 64; sq++ {
+		pt := r.square(origin, sq, flipped)
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" %s/>`+"\n", pt.X, pt.Y, sqz, sqz, svgFill("fill", colors[(sq.File()+sq.Rank())%2]))
+		if c, ok := highlight[sq]; ok {
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" %s/>`+"\n", pt.X, pt.Y, sqz, sqz, svgFill("fill", c))
+		}
+	}
+	for sq, piece := range d.Position.Board {
+		if piece != chess.NoPiece {
+			pt := r.square(origin, chess.Square(sq), flipped)
+			fmt.Fprintf(&b, `<use xlink:href="#%s" x="%d" y="%d" width="%d" height="%d"/>`+"\n", svgPieceID(piece), pt.X, pt.Y, sqz, sqz)
+		}
+	}
+	for _, a := range d.Arrows {
+		from, to := r.square(origin, a.From, flipped), r.square(origin, a.To, flipped)
+		// stop short so that the head ends at the center
+		x1, y1 := float64(from.X+sqz/2), float64(from.Y+sqz/2)
+		x2, y2 := float64(to.X+sqz/2), float64(to.Y+sqz/2)
+		width := float64(sqz) / 6
+		if l := math.Hypot(x2-x1, y2-y1); l > 0 {
+			x2 -= (x2 - x1) / l * width * 1.25
+			y2 -= (y2 - y1) / l * width * 1.25
+		}
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke-width="%.1f" %s marker-end="url(#%s)"/>`+"\n",
+			x1, y1, x2, y2, width, svgFill("stroke", a.Color), svgArrowheadID(a.Color))
+	}
+	if r.Coordinates {
+		for i := 0; i < 8; i++ {
+			file, rank := chess.Square(i), chess.Square(8*(7-i))
+			if flipped {
+				file, rank = 7-file, chess.Square(8*i)
+			}
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="%.1f" text-anchor="middle">%s</text>`+"\n",
+				origin.X+i*sqz+sqz/2, origin.Y+8*sqz+sqz/2-3, px*3/4, file.String()[:1])
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="%.1f" text-anchor="middle">%s</text>`+"\n",
+				origin.X/2, origin.Y+i*sqz+sqz/2+4, px*3/4, rank.String()[1:])
+		}
+	}
+	b.WriteString("</svg>\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func svgPieceID(p chess.Piece) string {
+	return p.Color().String() + string(p.Kind())
+}
+
+// svgArrowheadID names the marker of the arrows of color c. Each color
+// needs its own, since a marker does not take the color of its line.
+func svgArrowheadID(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("arrowhead-%02x%02x%02x%02x", n.R, n.G, n.B, n.A)
+}
+
+// svgFill sets attr, fill or stroke, to c with its opacity.
+func svgFill(attr string, c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	s := fmt.Sprintf(`%s="#%02x%02x%02x"`, attr, n.R, n.G, n.B)
+	if n.A != 0xff {
+		s += fmt.Sprintf(` %s-opacity="%.2f"`, attr, float64(n.A)/0xff)
+	}
+	return s
+}
+
+var svgEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace
+
+// The colors of [%csl] and [%cal]: green, red, yellow and blue.
+var markColors = map[byte]color.Color{
+	'G': color.NRGBA{0x15, 0x78, 0x1b, 0xa0},
+	'R': color.NRGBA{0x88, 0x20, 0x20, 0xa0},
+	'Y': color.NRGBA{0xe6, 0x8f, 0x00, 0xa0},
+	'B': color.NRGBA{0x00, 0x30, 0x88, 0xa0},
+}
+
+// pgnMovetext is the text of a game after its tags.
+func pgnMovetext(pgn []byte) string {
+	text := string(pgn)
+	for strings.HasPrefix(strings.TrimSpace(text), "[") {
+		text = strings.TrimSpace(text)
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			return ""
+		}
+		text = text[i+1:]
+	}
+	return strings.TrimSpace(text)
+}
+
+var markRe = regexp.MustCompile(`\[%(csl|cal)\s+([^\]]*)\]`)
+
+// setupMarks reads the squares and arrows in the comment before the
+// first move of a game, the only place they apply to the diagram.
+func setupMarks(pgn []byte) ([]Mark, []Arrow) {
+	text := pgnMovetext(pgn)
+	if !strings.HasPrefix(text, "{") {
+		return nil, nil
+	}
+	if i := strings.IndexByte(text, '}'); i > 0 {
+		text = text[:i]
+	}
+
+	var marks []Mark
+	var arrows []Arrow
+	for _, cmd := range markRe.FindAllStringSubmatch(text, -1) {
+		for _, item := range strings.Split(cmd[2], ",") {
+			item = strings.TrimSpace(item)
+			if len(item) < 3 {
+				continue
+			}
+			c, ok := markColors[item[0]]
+			if !ok {
+				continue
+			}
+			from, err := chess.ParseSquare(item[1:3])
+			if err != nil {
+				continue
+			}
+			if cmd[1] == "csl" {
+				marks = append(marks, Mark{from, c})
+			} else if len(item) == 5 {
+				if to, err := chess.ParseSquare(item[3:5]); err == nil {
+					arrows = append(arrows, Arrow{from, to, c})
+				}
+			}
+		}
+	}
+	return marks, arrows
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// maxChapters is the most chapters a lichess study can have.
+const maxChapters = 64
+
+// studyExport writes the studies as pgn files in the form of the study
+// exports of lichess: a chapter for each study and at most maxChapters
+// chapters, the most a lichess study has, in a file.
+//
+// A chapter has the signature in the ChapterName tag, and in Event for
+// the tools that go by that; the source it had goes to the Source tag.
+// The board is seen from the side to move, by the Orientation tag. These
+// are the tags of the lichess exports; whether an import into lichess
+// takes the names and orientations from them is up to lichess.
+type studyExport struct {
+	dir      string
+	manifest bool
+
+	file  *os.File
+	w     *bufio.Writer
+	files []exportFile
+}
+
+type exportFile struct {
+	File     string          `json:"file"`
+	Chapters []exportChapter `json:"chapters"`
+}
+
+type exportChapter struct {
+	Name        string `json:"name"`
+	Author      string `json:"author"`
+	Date        string `json:"date"`
+	Source      string `json:"source,omitempty"`
+	Orientation string `json:"orientation"`
+	FEN         string `json:"fen"`
+	Lichess     string `json:"lichess"`
+}
+
+// chapterTags are written first, in this order, and the others after
+// them sorted.
+var chapterTags = []string{"Event", "ChapterName", "Site", "Date", "Round", "White", "Black", "Result", "Source", "SetUp", "FEN", "Orientation"}
+
+var tagEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// add writes a chapter, starting a new file if the current one is full.
+func (x *studyExport) add(game *gochess.Game, meta StudyMeta, start *Diagram, sig, lichess string) error {
+	if x.file == nil || len(x.files[len(x.files)-1].Chapters) == maxChapters {
+		if err := x.next(); err != nil {
+			return err
+		}
+	}
+
+	orientation := "white"
+	if start.Position.Turn == chess.Black {
+		orientation = "black"
+	}
+	tags := make(map[string]string)
+	for k, v := range game.Tags {
+		tags[k] = v
+	}
+	tags["Event"] = sig
+	tags["ChapterName"] = sig
+	tags["SetUp"] = "1"
+	tags["Orientation"] = orientation
+	if meta.Source != "" {
+		tags["Source"] = meta.Source
+	}
+	movetext := pgnMovetext(game.PGNText)
+	if tags["Result"] == "" {
+		// the result the movetext ends with
+		tags["Result"] = "*"
+		if fields := strings.Fields(movetext); len(fields) > 0 {
+			switch last := fields[len(fields)-1]; last {
+			case "1-0", "0-1", "1/2-1/2":
+				tags["Result"] = last
+			}
+		}
+	}
+
+	written := make(map[string]bool)
+	for _, k := range chapterTags {
+		if v, ok := tags[k]; ok {
+			fmt.Fprintf(x.w, "[%s \"%s\"]\n", k, tagEscape.Replace(v))
+			written[k] = true
+		}
+	}
+	var rest []string
+	for k := range tags {
+		if !written[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		fmt.Fprintf(x.w, "[%s \"%s\"]\n", k, tagEscape.Replace(tags[k]))
+	}
+	if movetext == "" {
+		movetext = tags["Result"]
+	}
+	if _, err := fmt.Fprintf(x.w, "\n%s\n\n", movetext); err != nil {
+		return err
+	}
+
+	f := &x.files[len(x.files)-1]
+	f.Chapters = append(f.Chapters, exportChapter{
+		Name:        sig,
+		Author:      meta.Author,
+		Date:        meta.Date(),
+		Source:      meta.Source,
+		Orientation: orientation,
+		FEN:         game.Tags["FEN"],
+		Lichess:     lichess,
+	})
+	return nil
+}
+
+func (x *studyExport) next() error {
+	if err := x.closeFile(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(x.dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("study-%03d.pgn", len(x.files)+1)
+	f, err := os.Create(filepath.Join(x.dir, name))
+	if err != nil {
+		return err
+	}
+	x.file, x.w = f, bufio.NewWriter(f)
+	x.files = append(x.files, exportFile{File: name})
+	return nil
+}
+
+func (x *studyExport) closeFile() error {
+	if x.file == nil {
+		return nil
+	}
+	err := x.w.Flush()
+	if cerr := x.file.Close(); err == nil {
+		err = cerr
+	}
+	x.file, x.w = nil, nil
+	return err
+}
+
+// close ends the last file and writes the manifest, if asked to.
+func (x *studyExport) close() error {
+	if err := x.closeFile(); err != nil {
+		return err
+	}
+	if !x.manifest {
+		return nil
+	}
+	if x.files == nil {
+		x.files = []exportFile{}
+	}
+	if err := os.MkdirAll(x.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(x.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(x.dir, "manifest.json"), append(data, '\n'), 0644)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// TestStudyExport exports more studies than a file takes and reads the
+// files back.
+func TestStudyExport(t *testing.T) {
+	var games []*gochess.Game
+	parser := gochess.NewParser(strings.NewReader(testStudies))
+	for {
+		game, err := parser.NextGame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if game == nil {
+			break
+		}
+		games = append(games, game)
+	}
+
+	const n = maxChapters + 6
+	x := &studyExport{dir: t.TempDir(), manifest: true}
+	var sigs []string
+	orientations := make(map[string]string)
+	for i := 0; i < n; i++ {
+		game := games[i%len(games)]
+		meta, err := ParseStudyMeta(game.Tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, err := chess.ParseFEN(game.Tags["FEN"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := fmt.Sprintf("%s_%05d", meta.Result(), i+1)
+		sigs = append(sigs, sig)
+		orientations[sig] = "white"
+		if start.Turn == chess.Black {
+			orientations[sig] = "black"
+		}
+		if err := x.add(game, meta, &Diagram{Position: start}, sig, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := x.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(x.dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []exportFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || len(files[0].Chapters) != maxChapters || len(files[1].Chapters) != n-maxChapters {
+		t.Fatalf("manifest is %+v, want %d and %d chapters", files, maxChapters, n-maxChapters)
+	}
+
+	chapter := 0
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(x.dir, file.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parser := gochess.NewParser(f)
+		for i := 0; ; i++ {
+			game, err := parser.NextGame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if game == nil {
+				if i != len(file.Chapters) {
+					t.Errorf("%s has %d chapters, want %d", file.File, i, len(file.Chapters))
+				}
+				break
+			}
+			if chapter == n {
+				t.Fatalf("files have more than %d chapters", n)
+			}
+			sig := sigs[chapter]
+			chapter++
+			if name := game.Tags["ChapterName"]; name != sig || file.Chapters[i].Name != sig {
+				t.Errorf("%s chapter %d is named %s in the file and %s in the manifest, want %s", file.File, i+1, name, file.Chapters[i].Name, sig)
+			}
+			if game.Tags["Event"] != sig {
+				t.Errorf("%s chapter %d has Event %s, want %s", file.File, i+1, game.Tags["Event"], sig)
+			}
+			if o := game.Tags["Orientation"]; o != orientations[sig] {
+				t.Errorf("%s chapter %d has Orientation %s, want %s", file.File, i+1, o, orientations[sig])
+			}
+		}
+		f.Close()
+	}
+	if chapter != n {
+		t.Errorf("files have %d chapters, want %d", chapter, n)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+var (
+	sigRe = regexp.MustCompile("[wd]_[0-9]{6}_[0-9]{2,3}_[0-9]{2,3}_[0-9]{5}")
+)
+
+// captionFlags collects the repeated -caption flags, one per line.
+type captionFlags []string
+
+func (c *captionFlags) String() string { return strings.Join(*c, "|") }
+
+func (c *captionFlags) Set(s string) error {
+	*c = append(*c, s)
+	return nil
+}
+
+// studyDiagram is the diagram of the starting position of a study, with
+// the squares and arrows of its first comment.
+func studyDiagram(game *gochess.Game, meta StudyMeta) (*Diagram, error) {
+	p, err := chess.ParseFEN(game.Tags["FEN"])
+	if err != nil {
+		return nil, err
+	}
+
+	summary := "Draw."
+	if meta.Win {
+		summary = "Win."
+	}
+	if p.Turn == chess.White {
+		summary += " White to play"
+	} else {
+		summary += " Black to play"
+	}
+
+	this, total := variationsCount(game.Moves)
+	d := &Diagram{
+		Position: p,
+		Caption: Caption{
+			Tags:            game.Tags,
+			Author:          meta.Author,
+			Summary:         summary,
+			Source:          meta.Source,
+			Date:            meta.Date(),
+			Variations:      this,
+			TotalVariations: total,
+		},
+	}
+	d.Marks, d.Arrows = setupMarks(game.PGNText)
+	return d, nil
+}
+
+func renderBoard(r *DiagramRenderer, d *Diagram) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.Render(&buf, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// animation is how the main lines are animated, no animation if path is
+// empty. The first and the last position are shown for hold, the others
+// for delay.
+type animation struct {
+	path        string
+	delay, hold time.Duration
+}
+
+func renderAnimation(r *DiagramRenderer, game *gochess.Game, start *Diagram, a animation) ([]byte, error) {
+	frames, err := mainLine(game, start)
+	if err != nil {
+		return nil, err
+	}
+	delays := make([]time.Duration, len(frames))
+	for i := range delays {
+		delays[i] = a.delay
+	}
+	delays[0], delays[len(delays)-1] = a.hold, a.hold
+
+	var buf bytes.Buffer
+	if err := r.Animate(&buf, frames, delays); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func variationsCount(variation gochess.Variation) (int, int) {
+	total := 0
+	thisOnly := 0
+	if variation.Plies != nil {
+		total = 1
+		thisOnly = 1
+		for _, ply := range variation.Plies {
+			thisOnly += len(ply.Variations)
+			for _, v := range ply.Variations {
+				_, t := variationsCount(v)
+				total += t
+			}
+		}
+	}
+	return thisOnly, total
+}
+
+func gameSig(game *gochess.Game, meta StudyMeta, numGame int) string {
+	this, total := variationsCount(game.Moves)
+	sig := fmt.Sprintf("%s_%s_%02d_%02d_%05d", meta.Result(), strings.Replace(meta.GBR, ".", "", 1), this, total, numGame)
+
+	if !sigRe.MatchString(sig) {
+		log.Println("Game", numGame, "has an incompatible signature")
+	}
+
+	return sig
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "index":
+			indexCmd(os.Args[2:])
+			return
+		case "search":
+			searchCmd(os.Args[2:])
+			return
+		}
+	}
+	sqz := flag.Int("s", 30, "square size")
+	setFile := flag.String("set", "./ChessPiecesArray.png", "sprite sheet of the pieces")
+	format := flag.String("format", "jpeg", "diagram format: jpeg, png or svg")
+	flip := FlipNever
+	flag.Var(&flip, "flip", "show the board from black: never, always or black, when black is to move")
+	coords := flag.Bool("coords", false, "label the files and ranks")
+	var captions captionFlags
+	var anim animation
+	flag.StringVar(&anim.path, "gif", "", "directory to write an animated gif of the main line of each study to, none if empty")
+	flag.DurationVar(&anim.delay, "delay", time.Second, "time each move is shown in the gif")
+	flag.DurationVar(&anim.hold, "hold", 3*time.Second, "time the first and the last position are shown in the gif")
+	bad := badGamePolicy{action: "skip"}
+	flag.Var(&bad, "bad", "what to do with a study that cannot be converted: skip, quarantine or fail")
+	flag.StringVar(&bad.rejects, "rejects", "./rejects", "directory to quarantine bad studies in")
+	workers := flag.Int("j", runtime.NumCPU(), "studies to convert in parallel")
+	progress := flag.Duration("progress", 5*time.Second, "how often to report progress, never if 0")
+	resume := flag.Bool("resume", false, "skip the studies written as they would be now, by the sums file")
+	sumsFile := flag.String("sums", "hhdb.sums", "file of the hashes of the input and the output of each study")
+	lichessDir := flag.String("lichess", "", "directory to write the studies to as pgn files in the form of lichess study exports, none if empty")
+	manifest := flag.Bool("manifest", false, "write a json manifest of the files of -lichess too")
+	siteDir := flag.String("site", "", "directory to write a static site of the studies to, none if empty")
+	flag.Var(&captions, "caption", "template of a caption line, repeat for more lines, from the fields Author, Summary, Source, Date, Variations, TotalVariations and Tags")
+	flag.Parse()
+	if *workers < 1 {
+		log.Fatal("-j must be at least 1, not ", *workers)
+	}
+
+	r, err := NewDiagramRenderer(*setFile, *sqz)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.Format = *format
+	r.Flip = flip
+	r.Coordinates = *coords
+	if len(captions) > 0 {
+		if err := r.SetCaptions(captions); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fin, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal("Failed to open: ", err)
+	}
+	defer fin.Close()
+
+	fout, err := os.Create("for_lichess.txt")
+	if err != nil {
+		log.Fatal("Failed to create game index: ", err)
+	}
+	defer fout.Close()
+
+	p := &pipeline{
+		r:        r,
+		anim:     anim,
+		bad:      bad,
+		workers:  *workers,
+		progress: *progress,
+		resume:   *resume,
+		sumsFile: *sumsFile,
+	}
+	if *siteDir != "" {
+		p.site = &site{dir: *siteDir}
+	}
+	if *lichessDir != "" {
+		p.export = &studyExport{dir: *lichessDir, manifest: *manifest}
+	}
+	// a study is written again if any of these change
+	p.options = fmt.Sprintf("%s %d %s %v %v %v %v %v %v %v %s",
+		*setFile, r.SquareSize, r.Format, r.Flip, r.Coordinates, r.Light, r.Dark, r.Background, r.LastMove, anim, captions)
+
+	failed := p.run(fin, fout)
+
+	if p.export != nil {
+		if err := p.export.close(); err != nil {
+			log.Fatal("Failed to export studies: ", err)
+		}
+	}
+
+	if p.site != nil {
+		if err := p.site.write(); err != nil {
+			log.Fatal("Failed to write site: ", err)
+		}
+	}
+	if failed > 0 {
+		fout.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StudyMeta is what the tags of a study tell about it. The collection
+// keeps the author in White, as in A.=Troitzky, and the classification
+// in Black, as in (+0100.11a2): the stipulation, win or draw, and the
+// GBR code of the material with the square of the pawns or kings after
+// it. The Date is that of the publication and the Event its source.
+type StudyMeta struct {
+	Author string
+	Win    bool   // else a draw
+	GBR    string // as in 0100.11
+	Extra  string // the rest of the classification, as in a2
+	Source string
+
+	Year, Month, Day int // 0 if unknown
+}
+
+// StudyError lists the problems of the tags of a study.
+type StudyError struct {
+	Problems []string
+}
+
+func (e *StudyError) Error() string {
+	return "bad study tags: " + strings.Join(e.Problems, "; ")
+}
+
+var (
+	classRe = regexp.MustCompile(`^\(([+=])([0-9]{4}\.[0-9]{2})([^()]*)\)$`)
+	dateRe  = regexp.MustCompile(`^([0-9]{4}|\?{4})\.([0-9]{2}|\?\?)\.([0-9]{2}|\?\?)$`)
+)
+
+// ParseStudyMeta reads the tags of a study. The error, if any, is a
+// *StudyError with all the problems found.
+func ParseStudyMeta(tags map[string]string) (StudyMeta, error) {
+	var m StudyMeta
+	var problems []string
+
+	if author := strings.TrimSpace(tags["White"]); author == "" || author == "?" {
+		problems = append(problems, "no author in White")
+	} else {
+		m.Author = strings.ReplaceAll(author, "=", " ")
+	}
+
+	class := strings.TrimSpace(tags["Black"])
+	if g := classRe.FindStringSubmatch(class); g == nil {
+		problems = append(problems, fmt.Sprintf("classification '%s' in Black is not as (+0100.11a2)", class))
+	} else {
+		m.Win = g[1] == "+"
+		m.GBR = g[2]
+		m.Extra = strings.TrimSpace(g[3])
+	}
+
+	if date := strings.TrimSpace(tags["Date"]); date != "" {
+		if g := dateRe.FindStringSubmatch(date); g == nil {
+			problems = append(problems, fmt.Sprintf("date '%s' is not as 1910.??.??", date))
+		} else {
+			m.Year, _ = strconv.Atoi(g[1])
+			m.Month, _ = strconv.Atoi(g[2])
+			m.Day, _ = strconv.Atoi(g[3])
+			if m.Month > 12 || m.Day > 31 {
+				problems = append(problems, fmt.Sprintf("date '%s' has no such day", date))
+			}
+		}
+	}
+
+	if source := strings.TrimSpace(tags["Event"]); source != "?" {
+		m.Source = source
+	}
+
+	if strings.TrimSpace(tags["FEN"]) == "" {
+		problems = append(problems, "no FEN")
+	}
+
+	if problems != nil {
+		return m, &StudyError{problems}
+	}
+	return m, nil
+}
+
+// Result is the stipulation as the signatures have it, w or d.
+func (m StudyMeta) Result() string {
+	if m.Win {
+		return "w"
+	}
+	return "d"
+}
+
+// Date is the date as far as it is known, as in 1910 or 1910-05.
+func (m StudyMeta) Date() string {
+	switch {
+	case m.Year == 0:
+		return "?"
+	case m.Month == 0:
+		return fmt.Sprintf("%04d", m.Year)
+	case m.Day == 0:
+		return fmt.Sprintf("%04d-%02d", m.Year, m.Month)
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", m.Year, m.Month, m.Day)
+}
+
+// badGamePolicy is what to do with a study that cannot be converted.
+type badGamePolicy struct {
+	action  string // skip, quarantine or fail
+	rejects string // the directory of quarantined studies
+}
+
+func (p *badGamePolicy) String() string { return p.action }
+
+func (p *badGamePolicy) Set(s string) error {
+	switch s {
+	case "skip", "quarantine", "fail":
+		p.action = s
+		return nil
+	}
+	return fmt.Errorf("bad games policy must be skip, quarantine or fail, not '%s'", s)
+}
+
+// reject applies the policy to game numGame, with pgn its text. A
+// quarantined game is written in rejects with its number, and the reason
+// is appended to reasons.txt there.
+func (p *badGamePolicy) reject(numGame int, pgn []byte, reason error) error {
+	switch p.action {
+	case "fail":
+		return fmt.Errorf("game %d: %v", numGame, reason)
+	case "quarantine":
+		if err := os.MkdirAll(p.rejects, 0755); err != nil {
+			return err
+		}
+		fname := filepath.Join(p.rejects, fmt.Sprintf("%05d.pgn", numGame))
+		if err := ioutil.WriteFile(fname, pgn, 0644); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(p.rejects, "reasons.txt"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, "%05d %v\n", numGame, reason)
+		if err := f.Close(); err != nil {
+			return err
+		}
+		log.Println("Quarantined game", numGame, reason)
+		return nil
+	}
+	log.Println("Skipped game", numGame, reason)
+	return nil
+}
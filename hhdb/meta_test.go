@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anastasop/gochess"
+)
+
+func TestParseStudyMeta(t *testing.T) {
+	const fen = "8/8/8/8/1k6/8/1K1R4/8 b - - 0 1"
+	for _, c := range []struct {
+		tags     map[string]string
+		want     StudyMeta
+		problems []string
+	}{
+		{map[string]string{"White": "A.=Troitzky", "Black": "(+0100.11a2)", "Date": "1910.??.??", "Event": "Shakhmatny Listok", "FEN": fen},
+			StudyMeta{Author: "A. Troitzky", Win: true, GBR: "0100.11", Extra: "a2", Source: "Shakhmatny Listok", Year: 1910}, nil},
+		{map[string]string{"White": " H.=Rinck ", "Black": "(=0100.10 a3)", "Date": "????.??.??", "Event": "?", "FEN": fen},
+			StudyMeta{Author: "H. Rinck", GBR: "0100.10", Extra: "a3"}, nil},
+		{map[string]string{"White": "L.=Kubbel", "Black": "(+0130.22)", "Date": "1925.05.17", "FEN": fen},
+			StudyMeta{Author: "L. Kubbel", Win: true, GBR: "0130.22", Year: 1925, Month: 5, Day: 17}, nil},
+		{map[string]string{"White": "R.=Reti", "Black": "(=0000.11)", "Date": "1921.12.??", "FEN": fen},
+			StudyMeta{Author: "R. Reti", GBR: "0000.11", Year: 1921, Month: 12}, nil},
+		{map[string]string{"White": "?", "Black": "(+0100.11a2)", "FEN": fen},
+			StudyMeta{Win: true, GBR: "0100.11", Extra: "a2"}, []string{"no author"}},
+		{map[string]string{"White": "A.=Troitzky", "Black": "+0100.11", "FEN": fen},
+			StudyMeta{Author: "A. Troitzky"}, []string{"classification"}},
+		{map[string]string{"White": "A.=Troitzky", "Black": "(+0100.11)", "Date": "1910", "FEN": fen},
+			StudyMeta{Author: "A. Troitzky", Win: true, GBR: "0100.11"}, []string{"not as 1910.??.??"}},
+		{map[string]string{"White": "A.=Troitzky", "Black": "(+0100.11)", "Date": "1910.13.01", "FEN": fen},
+			StudyMeta{Author: "A. Troitzky", Win: true, GBR: "0100.11", Year: 1910, Month: 13, Day: 1}, []string{"no such day"}},
+		{map[string]string{},
+			StudyMeta{}, []string{"no author", "classification", "no FEN"}},
+	} {
+		m, err := ParseStudyMeta(c.tags)
+		if !reflect.DeepEqual(m, c.want) {
+			t.Errorf("%v gives %+v, want %+v", c.tags, m, c.want)
+		}
+		var serr *StudyError
+		if c.problems == nil {
+			if err != nil {
+				t.Errorf("%v: %v", c.tags, err)
+			}
+			continue
+		}
+		if !errors.As(err, &serr) || len(serr.Problems) != len(c.problems) {
+			t.Errorf("%v: error is %v, want the problems %q", c.tags, err, c.problems)
+			continue
+		}
+		for i, p := range c.problems {
+			if !strings.Contains(serr.Problems[i], p) {
+				t.Errorf("%v: problem %q is not about %q", c.tags, serr.Problems[i], p)
+			}
+		}
+	}
+}
+
+func TestStudyMetaDate(t *testing.T) {
+	for _, c := range []struct {
+		m    StudyMeta
+		want string
+	}{
+		{StudyMeta{}, "?"},
+		{StudyMeta{Year: 1910}, "1910"},
+		{StudyMeta{Year: 1921, Month: 12}, "1921-12"},
+		{StudyMeta{Year: 1925, Month: 5, Day: 17}, "1925-05-17"},
+	} {
+		if got := c.m.Date(); got != c.want {
+			t.Errorf("date of %+v is %s, want %s", c.m, got, c.want)
+		}
+	}
+}
+
+// testStudies are two studies of the collection, one with black to move.
+const testStudies = `[Event "Shakhmatny Listok"]
+[Date "1910.??.??"]
+[White "A.=Troitzky"]
+[Black "(+0100.11a2)"]
+[FEN "8/8/8/8/1k6/8/1K1R4/8 b - - 0 1"]
+
+{[%csl Gd2]} 1... Ka4 (1... Kc4 2. Rd8 (2. Rd7 Kb4) 2... Kb4) 2. Kc3 Ka3 3. Ra2# 1-0
+
+[Event "?"]
+[Date "????.??.??"]
+[White "H.=Rinck"]
+[Black "(=0100.10a3)"]
+[FEN "8/8/8/8/1k6/8/1K1R4/8 w - - 0 1"]
+
+1. Rd4+ Kc5 2. Rd1 1/2-1/2
+`
+
+// TestGameSig pins the signatures of known studies, which name the files
+// of earlier runs and must not change.
+func TestGameSig(t *testing.T) {
+	parser := gochess.NewParser(strings.NewReader(testStudies))
+	for n, want := range []string{"w_010011_02_03_00001", "d_010010_01_01_00002"} {
+		game, err := parser.NextGame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := game.ParseMovesText(); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := ParseStudyMeta(game.Tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig := gameSig(game, meta, n+1); sig != want {
+			t.Errorf("signature of game %d is %s, want %s", n+1, sig, want)
+		}
+	}
+}
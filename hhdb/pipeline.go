@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anastasop/gochess"
+)
+
+// pipeline converts the studies of a pgn file in parallel. One goroutine
+// parses the games and feeds them to the workers, which write the files
+// of each study. The outcomes are collected in the order of the games,
+// so the index and the site come out as from a single pass. At most
+// twice as many games as workers are between the parser and the
+// collector, so a slow study does not make the rest pile up behind it.
+// A parse error ends the input and fails the game it was found at.
+//
+// With resume on, a study is not written again if the sums file has its
+// output files with the same sums and the same input: the pgn text and
+// the options of the conversion.
+type pipeline struct {
+	r       *DiagramRenderer
+	anim    animation
+	site    *site
+	export  *studyExport
+	bad     badGamePolicy
+	workers int
+
+	progress time.Duration // how often to report, never if 0
+	resume   bool
+	sumsFile string
+	sums     map[string]sumsEntry // by signature
+	options  string               // what the input hash covers besides the pgn
+}
+
+type pipelineJob struct {
+	num  int
+	game *gochess.Game
+}
+
+type outcome struct {
+	num     int
+	game    *gochess.Game
+	sig     string
+	lichess string
+	meta    StudyMeta
+	start   *Diagram
+	diagram string
+	gif     string
+	sums    sumsEntry
+	resumed bool
+
+	bad      error // the study cannot be converted
+	err      error // the study could not be written
+	warnings []string
+}
+
+// sumsEntry is a line of the sums file: the signature, the hash of the
+// input and the files written with their hashes.
+type sumsEntry struct {
+	sig   string
+	input string
+	files []string
+	sums  []string
+}
+
+func (e sumsEntry) String() string {
+	var b strings.Builder
+	b.WriteString(e.sig + " " + e.input)
+	for i, f := range e.files {
+		b.WriteString(" " + f + "=" + e.sums[i])
+	}
+	return b.String()
+}
+
+func hashOf(data ...[]byte) string {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func readSums(fname string) (map[string]sumsEntry, error) {
+	sums := make(map[string]sumsEntry)
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return sums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		e := sumsEntry{sig: fields[0], input: fields[1]}
+		for _, fs := range fields[2:] {
+			if i := strings.LastIndexByte(fs, '='); i > 0 {
+				e.files = append(e.files, fs[:i])
+				e.sums = append(e.sums, fs[i+1:])
+			}
+		}
+		// later lines are from later runs
+		sums[e.sig] = e
+	}
+	return sums, s.Err()
+}
+
+// done reports whether the files of e are there as they were written.
+func (e sumsEntry) done() bool {
+	for i, f := range e.files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil || hashOf(data) != e.sums[i] {
+			return false
+		}
+	}
+	return len(e.files) > 0
+}
+
+func (p *pipeline) write(o *outcome, fname string, data []byte) error {
+	if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+		return err
+	}
+	o.sums.files = append(o.sums.files, fname)
+	o.sums.sums = append(o.sums.sums, hashOf(data))
+	return nil
+}
+
+// convert writes the files of a study.
+func (p *pipeline) convert(j pipelineJob) *outcome {
+	o := &outcome{num: j.num, game: j.game}
+	game := j.game
+	if o.bad = game.ParseMovesText(); o.bad != nil {
+		return o
+	}
+	if o.meta, o.bad = ParseStudyMeta(game.Tags); o.bad != nil {
+		return o
+	}
+	if o.start, o.bad = studyDiagram(game, o.meta); o.bad != nil {
+		return o
+	}
+	o.sig = gameSig(game, o.meta, j.num)
+	fen := strings.Join(strings.Fields(game.Tags["FEN"]), "_")
+	o.lichess = "https://lichess.org/analysis/standard/" + fen
+	o.diagram = "./" + p.r.Ext() + "/" + o.sig + "." + p.r.Ext()
+	if p.anim.path != "" {
+		o.gif = p.anim.path + "/" + o.sig + ".gif"
+	}
+
+	o.sums = sumsEntry{sig: o.sig, input: hashOf([]byte(p.options), game.PGNText)}
+	if p.resume {
+		if e, ok := p.sums[o.sig]; ok && e.input == o.sums.input && e.done() {
+			o.sums, o.resumed = e, true
+			if !e.has(o.gif) {
+				o.gif = ""
+			}
+			return o
+		}
+	}
+
+	if o.err = p.write(o, "./pgn/"+o.sig+".pgn", game.PGNText); o.err != nil {
+		return o
+	}
+	data, err := renderBoard(p.r, o.start)
+	if err == nil {
+		err = p.write(o, o.diagram, data)
+	}
+	if err != nil {
+		o.err = fmt.Errorf("diagram: %v", err)
+		return o
+	}
+	if o.gif != "" {
+		data, err := renderAnimation(p.r, game, o.start, p.anim)
+		if err == nil {
+			err = p.write(o, o.gif, data)
+		}
+		if err != nil {
+			o.warnings = append(o.warnings, fmt.Sprintf("game %d: no animation: %v", j.num, err))
+			o.gif = ""
+		}
+	}
+	return o
+}
+
+func (e sumsEntry) has(fname string) bool {
+	for _, f := range e.files {
+		if f == fname {
+			return true
+		}
+	}
+	return false
+}
+
+// run converts the games of in, writes the index to index and returns
+// the number of studies that failed.
+func (p *pipeline) run(in io.Reader, index io.Writer) int {
+	var err error
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if p.resume {
+		if p.sums, err = readSums(p.sumsFile); err != nil {
+			log.Fatal("Failed to read sums: ", err)
+		}
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	sumsOut, err := os.OpenFile(p.sumsFile, flags, 0644)
+	if err != nil {
+		log.Fatal("Failed to open sums: ", err)
+	}
+	defer sumsOut.Close()
+
+	jobs := make(chan pipelineJob, p.workers)
+	outcomes := make(chan *outcome, p.workers)
+	// a game takes a slot when parsed and frees it when collected
+	inflight := make(chan struct{}, 2*p.workers)
+	go func() {
+		defer close(jobs)
+		parser := gochess.NewParser(in)
+		for n := 1; ; n++ {
+			game, err := parser.NextGame()
+			if game == nil && err == nil {
+				return
+			}
+			inflight <- struct{}{}
+			if err != nil {
+				outcomes <- &outcome{num: n, err: fmt.Errorf("cannot parse: %v", err)}
+				return
+			}
+			jobs <- pipelineJob{n, game}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				outcomes <- p.convert(j)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(outcomes)
+	}()
+
+	var (
+		games, written, resumed, bad int
+		failures, warnings           []string
+	)
+	start := time.Now()
+	report := func() {
+		log.Printf("%d games, %d written, %d resumed, %d bad, %d failed, %.0f games/s",
+			games, written, resumed, bad, len(failures), float64(games)/time.Since(start).Seconds())
+	}
+	var tick <-chan time.Time
+	if p.progress > 0 {
+		ticker := time.NewTicker(p.progress)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	pending := make(map[int]*outcome)
+	next := 1
+	for results := (<-chan *outcome)(outcomes); results != nil; {
+		select {
+		case <-tick:
+			report()
+			continue
+		case o, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			pending[o.num] = o
+		}
+		for o := pending[next]; o != nil; o = pending[next] {
+			delete(pending, next)
+			next++
+			<-inflight
+			games++
+			warnings = append(warnings, o.warnings...)
+			switch {
+			case o.bad != nil:
+				bad++
+				if err := p.bad.reject(o.num, o.game.PGNText, o.bad); err != nil {
+					log.Fatal(err)
+				}
+				continue
+			case o.err != nil:
+				failures = append(failures, fmt.Sprintf("game %d: %v", o.num, o.err))
+				continue
+			case o.resumed:
+				resumed++
+			default:
+				written++
+				if _, err := fmt.Fprintln(sumsOut, o.sums); err != nil {
+					log.Fatal("Failed to write sums: ", err)
+				}
+			}
+			if _, err := fmt.Fprintf(index, "%s %s\n", o.sig, o.lichess); err != nil {
+				log.Fatal("Failed to write index entry ", err)
+			}
+			if p.site != nil {
+				p.site.add(o.game, o.meta, o.start, o.sig, o.diagram, o.gif, o.lichess)
+			}
+			if p.export != nil {
+				if err := p.export.add(o.game, o.meta, o.start, o.sig, o.lichess); err != nil {
+					log.Fatal("Failed to export study: ", err)
+				}
+			}
+		}
+	}
+
+	report()
+	for _, w := range warnings {
+		log.Println("Warning:", w)
+	}
+	for _, f := range failures {
+		log.Println("Failed:", f)
+	}
+	return len(failures)
+}
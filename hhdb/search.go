@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// The position index has a JSON entry per line for every position the
+// studies of a collection reach, in the main line or a variation, sorted
+// by material and hash. A search by position or material bisects the
+// file to the entries of that material and reads only them; one by
+// pattern reads it through. Neither keeps more than its answer.
+type positionEntry struct {
+	Hash     string   `json:"hash"` // the polyglot key, in hex
+	Material string   `json:"material"`
+	FEN      string   `json:"fen"` // without the move counters
+	Studies  []string `json:"studies"`
+}
+
+// materialSig is the material of p as in KRPkr: the white pieces in the
+// order KQRBNP and then the black ones.
+func materialSig(p *chess.Position) string {
+	var b strings.Builder
+	for _, side := range []string{"KQRBNP", "kqrbnp"} {
+		for _, kind := range side {
+			for _, piece := range p.Board {
+				if piece == chess.Piece(kind) {
+					b.WriteRune(kind)
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// parseMaterial reads a material as in KRPkr, with the pieces in any
+// order, or as in KRPvKR, and writes it as materialSig does.
+func parseMaterial(s string) (string, error) {
+	if i := strings.IndexByte(s, 'v'); i >= 0 {
+		s = strings.ToUpper(s[:i]) + strings.ToLower(s[i+1:])
+	}
+	count := make(map[rune]int)
+	for _, c := range s {
+		if !strings.ContainsRune("KQRBNPkqrbnp", c) {
+			return "", fmt.Errorf("material '%s' has '%c', not a piece", s, c)
+		}
+		count[c]++
+	}
+	if count['K'] != 1 || count['k'] != 1 {
+		return "", fmt.Errorf("material '%s' needs a king for each side", s)
+	}
+	var b strings.Builder
+	for _, c := range "KQRBNPkqrbnp" {
+		b.WriteString(strings.Repeat(string(c), count[c]))
+	}
+	return b.String(), nil
+}
+
+// pattern is a partial placement, as in "Kg1 Rf1 ke8": the positions
+// with these pieces on these squares, whatever else is on the board.
+type pattern map[chess.Square]chess.Piece
+
+func parsePattern(s string) (pattern, error) {
+	pat := make(pattern)
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if len(item) != 3 || !strings.ContainsRune("KQRBNPkqrbnp", rune(item[0])) {
+			return nil, fmt.Errorf("pattern item '%s' is not a piece and a square, as Kg1", item)
+		}
+		sq, err := chess.ParseSquare(item[1:])
+		if err != nil {
+			return nil, err
+		}
+		pat[sq] = chess.Piece(item[0])
+	}
+	if len(pat) == 0 {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	return pat, nil
+}
+
+// matches reads only the placement of fen, as the entries of the index
+// are valid positions.
+func (pat pattern) matches(fen string) bool {
+	var board [64]chess.Piece
+	sq := 56
+	for i := 0; i < len(fen) && fen[i] != ' '; i++ {
+		switch c := fen[i]; {
+		case c == '/':
+			sq -= 16
+		case c >= '1' && c <= '8':
+			sq += int(c - '0')
+		default:
+			if sq >= 0 && sq < 64 {
+				board[sq] = chess.Piece(c)
+			}
+			sq++
+		}
+	}
+	for sq, piece := range pat {
+		if board[sq] != piece {
+			return false
+		}
+	}
+	return true
+}
+
+// walkLine calls visit with the position after each move of v, from p,
+// and of the variations, which start from the position before the move
+// they replace.
+func walkLine(p *chess.Position, v gochess.Variation, visit func(*chess.Position)) error {
+	for i, ply := range v.Plies {
+		for _, alt := range ply.Variations {
+			if err := walkLine(p, alt, visit); err != nil {
+				return err
+			}
+		}
+		m, err := p.ParseSAN(ply.SAN)
+		if err != nil {
+			return fmt.Errorf("ply %d %s: %v", i+1, ply.SAN, err)
+		}
+		p = p.Play(m)
+		visit(p)
+	}
+	return nil
+}
+
+func positionLess(a, b *positionEntry) bool {
+	if a.Material != b.Material {
+		return a.Material < b.Material
+	}
+	return a.Hash < b.Hash
+}
+
+// positionRuns collects the entries of the index. It keeps up to max
+// positions in memory and then writes them, sorted, as a run to a
+// temporary file. The runs are merged when the index is written.
+type positionRuns struct {
+	max       int
+	positions map[uint64]*positionEntry
+	runs      []*os.File
+}
+
+func (pr *positionRuns) add(p *chess.Position, sig string) error {
+	key := p.PolyglotKey()
+	e := pr.positions[key]
+	if e == nil {
+		if len(pr.positions) >= pr.max {
+			if err := pr.spill(); err != nil {
+				return err
+			}
+		}
+		e = &positionEntry{Hash: strconv.FormatUint(key, 16), Material: materialSig(p), FEN: p.Key()}
+		pr.positions[key] = e
+	}
+	e.Studies = append(e.Studies, sig)
+	return nil
+}
+
+func (pr *positionRuns) sorted() []*positionEntry {
+	entries := make([]*positionEntry, 0, len(pr.positions))
+	for _, e := range pr.positions {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return positionLess(entries[i], entries[j]) })
+	return entries
+}
+
+func writeEntries(w io.Writer, entries []*positionEntry) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (pr *positionRuns) spill() error {
+	f, err := ioutil.TempFile("", "hhdb-index-")
+	if err != nil {
+		return err
+	}
+	pr.runs = append(pr.runs, f)
+	if err := writeEntries(f, pr.sorted()); err != nil {
+		return err
+	}
+	pr.positions = make(map[uint64]*positionEntry)
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// write writes the index to w and returns the number of positions. The
+// entries of a position in many runs are joined, with the studies in the
+// order they were added.
+func (pr *positionRuns) write(w io.Writer) (int, error) {
+	if len(pr.runs) == 0 {
+		entries := pr.sorted()
+		return len(entries), writeEntries(w, entries)
+	}
+	if len(pr.positions) > 0 {
+		if err := pr.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var h runHeap
+	for i, f := range pr.runs {
+		r := &run{n: i, dec: json.NewDecoder(bufio.NewReader(f))}
+		if ok, err := r.next(); err != nil {
+			return 0, err
+		} else if ok {
+			h = append(h, r)
+		}
+	}
+	heap.Init(&h)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	var last *positionEntry
+	for h.Len() > 0 {
+		r := h[0]
+		e := r.e
+		if ok, err := r.next(); err != nil {
+			return n, err
+		} else if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+		if last != nil && last.Material == e.Material && last.Hash == e.Hash {
+			last.Studies = append(last.Studies, e.Studies...)
+			continue
+		}
+		if last != nil {
+			if err := enc.Encode(last); err != nil {
+				return n, err
+			}
+			n++
+		}
+		last = e
+	}
+	if last != nil {
+		if err := enc.Encode(last); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// close removes the runs.
+func (pr *positionRuns) close() {
+	for _, f := range pr.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// run is a run being merged, at entry e.
+type run struct {
+	n   int
+	dec *json.Decoder
+	e   *positionEntry
+}
+
+func (r *run) next() (bool, error) {
+	e := new(positionEntry)
+	if err := r.dec.Decode(e); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r.e = e
+	return true, nil
+}
+
+// runHeap orders the runs by their entries, and the runs of the same
+// entry as they were written.
+type runHeap []*run
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if positionLess(h[i].e, h[j].e) || positionLess(h[j].e, h[i].e) {
+		return positionLess(h[i].e, h[j].e)
+	}
+	return h[i].n < h[j].n
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+func indexCmd(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	output := fs.String("o", "positions.idx", "index to write")
+	mem := fs.Int("mem", 1000000, "positions to keep in memory, more are sorted on disk")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: hhdb index [-o positions.idx] studies.pgn")
+	}
+
+	fin, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal("Failed to open: ", err)
+	}
+	defer fin.Close()
+
+	positions := &positionRuns{max: *mem, positions: make(map[uint64]*positionEntry)}
+	defer positions.close()
+	ngame, skipped := 0, 0
+	parser := gochess.NewParser(fin)
+	for {
+		game, err := parser.NextGame()
+		if err != nil {
+			log.Fatal("Failed to parse: ", err)
+		}
+		if game == nil {
+			break
+		}
+		ngame++
+		err = game.ParseMovesText()
+		var meta StudyMeta
+		if err == nil {
+			meta, err = ParseStudyMeta(game.Tags)
+		}
+		var start *chess.Position
+		if err == nil {
+			start, err = chess.ParseFEN(game.Tags["FEN"])
+		}
+		if err != nil {
+			log.Println("Skipped game", ngame, err)
+			skipped++
+			continue
+		}
+		// signatures as the conversion of the same file gives them
+		sig := gameSig(game, meta, ngame)
+
+		seen := make(map[uint64]bool)
+		visit := func(p *chess.Position) {
+			key := p.PolyglotKey()
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+			if err := positions.add(p, sig); err != nil {
+				log.Fatal("Failed to sort positions: ", err)
+			}
+		}
+		visit(start)
+		if err := walkLine(start, game.Moves, visit); err != nil {
+			log.Println("Game", ngame, "is indexed up to", err)
+		}
+	}
+
+	fout, err := os.Create(*output)
+	if err != nil {
+		log.Fatal("Failed to create index: ", err)
+	}
+	n, err := positions.write(fout)
+	if err == nil {
+		err = fout.Close()
+	}
+	if err != nil {
+		log.Fatal("Failed to write index: ", err)
+	}
+	log.Println("Indexed", n, "positions of", ngame-skipped, "studies,", skipped, "skipped")
+}
+
+// entryAt reads the first entry of the index in r that starts at off or
+// after it, and returns its offset. The entry is nil past the last one.
+func entryAt(r io.ReaderAt, size, off int64) (int64, *positionEntry, error) {
+	if off > 0 {
+		// the entry starts after the newline before off, if off is not
+		// a start already
+		skipped, err := bufio.NewReader(io.NewSectionReader(r, off-1, size-off+1)).ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil, nil
+		} else if err != nil {
+			return 0, nil, err
+		}
+		off += int64(len(skipped)) - 1
+	}
+	if off >= size {
+		return size, nil, nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(r, off, size-off)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	e := new(positionEntry)
+	if err := json.Unmarshal(line, e); err != nil {
+		return 0, nil, fmt.Errorf("offset %d: %v", off, err)
+	}
+	return off, e, nil
+}
+
+// seekMaterial moves f to the first entry of the index whose material
+// is m or sorts after it.
+func seekMaterial(f *os.File, m string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, e, err := entryAt(f, size, mid)
+		if err != nil {
+			return err
+		}
+		if e == nil || e.Material >= m {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	start, _, err := entryAt(f, size, lo)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(start, io.SeekStart)
+	return err
+}
+
+// searchIndex reads the index in r until its end or an entry past ends,
+// and calls found with the entries match accepts.
+func searchIndex(r io.Reader, past, match func(*positionEntry) bool, found func(*positionEntry)) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e positionEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if past(&e) {
+			return nil
+		}
+		if match(&e) {
+			found(&e)
+		}
+	}
+}
+
+func searchCmd(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	index := fs.String("i", "positions.idx", "index to search")
+	fen := fs.String("fen", "", "studies that reach this position")
+	pat := fs.String("pattern", "", "studies that reach a position with these pieces on these squares, as \"Kg1 Rf1 ke8\"")
+	mat := fs.String("material", "", "studies that reach this material, as KRPkr or KRPvKR")
+	showPositions := fs.Bool("positions", false, "list every position found with its study, not just the studies")
+	fs.Parse(args)
+
+	var matchers []func(*positionEntry) bool
+	material := "" // of the positions searched, if it is known
+	if *fen != "" {
+		p, err := chess.ParseFEN(*fen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hash := strconv.FormatUint(p.PolyglotKey(), 16)
+		matchers = append(matchers, func(e *positionEntry) bool { return e.Hash == hash })
+		material = materialSig(p)
+	}
+	if *mat != "" {
+		m, err := parseMaterial(*mat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		matchers = append(matchers, func(e *positionEntry) bool { return e.Material == m })
+		material = m
+	}
+	if *pat != "" {
+		pt, err := parsePattern(*pat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		matchers = append(matchers, func(e *positionEntry) bool { return pt.matches(e.FEN) })
+	}
+	if len(matchers) == 0 {
+		log.Fatal("usage: hhdb search [-i positions.idx] -fen FEN | -pattern \"Kg1 ke8\" | -material KRPkr")
+	}
+
+	f, err := os.Open(*index)
+	if err != nil {
+		log.Fatal("Failed to open index: ", err)
+	}
+	defer f.Close()
+	if material != "" {
+		if err := seekMaterial(f, material); err != nil {
+			log.Fatal("Failed to read index: ", err)
+		}
+	}
+
+	studies := make(map[string]bool)
+	past := func(e *positionEntry) bool { return material != "" && e.Material > material }
+	err = searchIndex(f, past, func(e *positionEntry) bool {
+		for _, m := range matchers {
+			if !m(e) {
+				return false
+			}
+		}
+		return true
+	}, func(e *positionEntry) {
+		for _, sig := range e.Studies {
+			if *showPositions {
+				fmt.Println(sig, e.FEN)
+			}
+			studies[sig] = true
+		}
+	})
+	if err != nil {
+		log.Fatal("Failed to read index: ", err)
+	}
+	if !*showPositions {
+		sigs := sortedKeys(studies)
+		for _, sig := range sigs {
+			fmt.Println(sig)
+		}
+	}
+}
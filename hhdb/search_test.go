@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anastasop/oneshot/chess"
+)
+
+func TestParseMaterial(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"KRPkr", "KRPkr"},
+		{"PRKrk", "KRPkr"},
+		{"KRPvKR", "KRPkr"},
+		{"KvK", "Kk"},
+		{"kK", "Kk"},
+	} {
+		if got, err := parseMaterial(c.in); err != nil || got != c.want {
+			t.Errorf("parseMaterial(%s) = %s, %v, want %s", c.in, got, err, c.want)
+		}
+	}
+	for _, bad := range []string{"KRk2", "KRr", "KKk", ""} {
+		if got, err := parseMaterial(bad); err == nil {
+			t.Errorf("parseMaterial(%s) = %s, want an error", bad, got)
+		}
+	}
+}
+
+func TestPatternMatches(t *testing.T) {
+	const fen = "r3k2r/8/8/8/8/8/4P3/R3K2R w KQkq -"
+	for _, c := range []struct {
+		pattern string
+		match   bool
+	}{
+		{"Ke1", true},
+		{"Ke1 Ra1 Rh1 ke8", true},
+		{"Pe2, ra8", true},
+		{"Ke2", false},
+		{"ke1", false},
+		{"Pe3", false},
+		{"Ra1 Nb1", false},
+	} {
+		pat, err := parsePattern(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pat.matches(fen); got != c.match {
+			t.Errorf("pattern %s matches %s is %v, want %v", c.pattern, fen, got, c.match)
+		}
+	}
+	for _, bad := range []string{"", "Ke", "Xe1", "Ke9"} {
+		if _, err := parsePattern(bad); err == nil {
+			t.Errorf("pattern '%s' is accepted", bad)
+		}
+	}
+}
+
+// indexPositions are the positions of the index tests, by study.
+var indexPositions = []struct {
+	fen, sig string
+}{
+	{"8/8/8/8/1k6/8/1K1R4/8 w - - 0 1", "a"},
+	{"8/8/8/8/1k6/8/1K1R4/8 b - - 0 1", "a"},
+	{"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", "a"},
+	{"r3k3/8/8/8/8/8/8/R3K3 w - - 0 1", "b"},
+	{"4k3/4p3/8/8/8/8/4P3/4K3 w - - 0 1", "b"},
+	{"4k3/8/8/8/8/8/8/4KQ2 w - - 0 1", "b"},
+	{"8/8/8/2k5/8/8/1K1R4/8 w - - 0 1", "c"},
+	{"4k3/8/8/8/8/8/4P3/4K3 b - - 0 1", "c"},
+	{"8/8/8/8/1k6/8/1K1R4/8 w - - 0 1", "c"},
+	{"4k3/8/8/8/8/8/8/4KQ2 w - - 0 1", "d"},
+}
+
+// writeIndex writes the index of indexPositions, keeping max positions
+// in memory.
+func writeIndex(t *testing.T, max int) ([]byte, int) {
+	t.Helper()
+	pr := &positionRuns{max: max, positions: make(map[uint64]*positionEntry)}
+	defer pr.close()
+	for _, ip := range indexPositions {
+		p, err := chess.ParseFEN(ip.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.add(p, ip.sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if max < len(indexPositions) && len(pr.runs) == 0 {
+		t.Fatal("no runs were written")
+	}
+	var b bytes.Buffer
+	n, err := pr.write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes(), n
+}
+
+func TestPositionIndex(t *testing.T) {
+	inMemory, n := writeIndex(t, 100)
+	if n != 8 {
+		t.Errorf("index has %d positions, want 8", n)
+	}
+	merged, n := writeIndex(t, 2)
+	if n != 8 {
+		t.Errorf("merged index has %d positions, want 8", n)
+	}
+	if !bytes.Equal(inMemory, merged) {
+		t.Errorf("merged index is\n%s\nwant\n%s", merged, inMemory)
+	}
+
+	path := filepath.Join(t.TempDir(), "positions.idx")
+	if err := ioutil.WriteFile(path, merged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var all []*positionEntry
+	if err := searchIndex(f, func(*positionEntry) bool { return false }, func(*positionEntry) bool { return true }, func(e *positionEntry) {
+		all = append(all, e)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(all); i++ {
+		if !positionLess(all[i-1], all[i]) {
+			t.Errorf("entry %d %s %s is not after %s %s", i, all[i].Material, all[i].Hash, all[i-1].Material, all[i-1].Hash)
+		}
+	}
+
+	// the material searches, found by bisecting, and the studies of each
+	// position, in the order they were added
+	for _, c := range []struct {
+		material string
+		studies  map[string][]string
+	}{
+		{"KRk", map[string][]string{
+			"8/8/8/8/1k6/8/1K1R4/8 w - -": {"a", "c"},
+			"8/8/8/8/1k6/8/1K1R4/8 b - -": {"a"},
+			"8/8/8/2k5/8/8/1K1R4/8 w - -": {"c"},
+		}},
+		{"KPk", map[string][]string{
+			"4k3/8/8/8/8/8/4P3/4K3 w - -": {"a"},
+			"4k3/8/8/8/8/8/4P3/4K3 b - -": {"c"},
+		}},
+		{"KPkp", map[string][]string{"4k3/4p3/8/8/8/8/4P3/4K3 w - -": {"b"}}},
+		{"KQk", map[string][]string{"4k3/8/8/8/8/8/8/4KQ2 w - -": {"b", "d"}}},
+		{"KRkr", map[string][]string{"r3k3/8/8/8/8/8/8/R3K3 w - -": {"b"}}},
+		{"KBk", nil},  // before the first
+		{"KQkq", nil}, // between two
+		{"Kk", nil},   // after the last
+	} {
+		if err := seekMaterial(f, c.material); err != nil {
+			t.Fatal(err)
+		}
+		var found map[string][]string
+		past := func(e *positionEntry) bool { return e.Material > c.material }
+		match := func(e *positionEntry) bool { return e.Material == c.material }
+		if err := searchIndex(f, past, match, func(e *positionEntry) {
+			if found == nil {
+				found = make(map[string][]string)
+			}
+			found[e.FEN] = e.Studies
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(found, c.studies) {
+			t.Errorf("material %s finds %v, want %v", c.material, found, c.studies)
+		}
+	}
+
+	// a pattern reads the index through
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	pat, err := parsePattern("Kb2 Rd2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fens []string
+	if err := searchIndex(f, func(*positionEntry) bool { return false }, func(e *positionEntry) bool { return pat.matches(e.FEN) }, func(e *positionEntry) {
+		fens = append(fens, e.FEN)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fens) != 3 {
+		t.Errorf("pattern Kb2 Rd2 finds %v, want the 3 positions of KRk", fens)
+	}
+}
+
+// TestEntryAt checks that entryAt finds the entry after
+// any offset, the start of an entry or the middle of one.
+func TestEntryAt(t *testing.T) {
+	index, _ := writeIndex(t, 100)
+	r := bytes.NewReader(index)
+	size := int64(len(index))
+	var starts []int64
+	for off := int64(0); off < size; off++ {
+		if off == 0 || index[off-1] == '\n' {
+			starts = append(starts, off)
+		}
+	}
+	next := 0
+	for off := int64(0); off <= size; off++ {
+		for next < len(starts) && starts[next] < off {
+			next++
+		}
+		got, e, err := entryAt(r, size, off)
+		if err != nil {
+			t.Fatalf("offset %d: %v", off, err)
+		}
+		if next == len(starts) {
+			if e != nil || got != size {
+				t.Errorf("offset %d gives the entry at %d, want none", off, got)
+			}
+		} else if e == nil || got != starts[next] {
+			t.Errorf("offset %d gives the entry at %d, want %d", off, got, starts[next])
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// site is a static site of the studies: an index page to sort and filter
+// them and a page for each one. The pages are written last, in dir, and
+// link to the pgn and the diagrams in the directories next to it.
+type site struct {
+	dir     string
+	studies []*siteStudy
+}
+
+type siteStudy struct {
+	Sig     string
+	Author  string
+	Result  string // Win or Draw
+	Year    string
+	Source  string
+	GBR     string
+	Summary string
+	Diagram string
+	GIF     string
+	PGN     string
+	Lichess string
+	Moves   template.HTML
+
+	Variations, TotalVariations int
+	Prev, Next                  string
+}
+
+// add keeps a study for the pages. The diagram and the gif, if any, are
+// paths relative to the working directory, as are the pgn files. The
+// year is the one of the Date tag, as the signature has none, and empty
+// if the tag has none either.
+func (s *site) add(game *gochess.Game, meta StudyMeta, d *Diagram, sig, diagram, gif, lichess string) {
+	st := &siteStudy{
+		Sig:     sig,
+		Author:  d.Caption.Author,
+		Source:  meta.Source,
+		GBR:     meta.GBR + meta.Extra,
+		Summary: d.Caption.Summary,
+		Diagram: s.link(diagram),
+		PGN:     s.link("./pgn/" + sig + ".pgn"),
+		Lichess: lichess,
+		Moves:   moveTree(game.Moves, d.Position.FullMoves, d.Position.Turn == chess.Black),
+
+		Variations:      d.Caption.Variations,
+		TotalVariations: d.Caption.TotalVariations,
+	}
+	if meta.Win {
+		st.Result = "Win"
+	} else {
+		st.Result = "Draw"
+	}
+	if meta.Year != 0 {
+		st.Year = fmt.Sprint(meta.Year)
+	}
+	if gif != "" {
+		st.GIF = s.link(gif)
+	}
+	s.studies = append(s.studies, st)
+}
+
+// link is the path of p, relative to the working directory, from the
+// pages of the site.
+func (s *site) link(p string) string {
+	if filepath.IsAbs(p) {
+		return "file://" + filepath.ToSlash(p)
+	}
+	// Rel cannot relate an absolute dir to the relative "."
+	dir, err := filepath.Abs(s.dir)
+	if err != nil {
+		return p
+	}
+	wd, err := filepath.Abs(".")
+	if err != nil {
+		return p
+	}
+	rel, err := filepath.Rel(dir, wd)
+	if err != nil {
+		return p
+	}
+	return path.Join(filepath.ToSlash(rel), filepath.ToSlash(p))
+}
+
+// moveTree is the moves of v as html, the variations in parentheses
+// after the move they replace. The first move is number n, of black if
+// black is set.
+func moveTree(v gochess.Variation, n int, black bool) template.HTML {
+	var b strings.Builder
+	writeMoves(&b, v, n, black)
+	return template.HTML(b.String())
+}
+
+func writeMoves(b *strings.Builder, v gochess.Variation, n int, black bool) {
+	numbered := false
+	for i, ply := range v.Plies {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		if !black {
+			fmt.Fprintf(b, `<span class="num">%d.</span> `, n)
+		} else if !numbered {
+			fmt.Fprintf(b, `<span class="num">%d...</span> `, n)
+		}
+		numbered = true
+		fmt.Fprintf(b, `<span class="move">%s</span>`, html.EscapeString(ply.SAN))
+		for _, alt := range ply.Variations {
+			b.WriteString(` <span class="variation">(`)
+			writeMoves(b, alt, n, black)
+			b.WriteString(`)</span>`)
+			// the main line goes on numbered after a variation
+			numbered = false
+		}
+		if black {
+			n++
+		}
+		black = !black
+	}
+}
+
+func (s *site) write() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	for i, st := range s.studies {
+		if i > 0 {
+			st.Prev = s.studies[i-1].Sig + ".html"
+		}
+		if i < len(s.studies)-1 {
+			st.Next = s.studies[i+1].Sig + ".html"
+		}
+		if err := writeTemplate(filepath.Join(s.dir, st.Sig+".html"), studyPage, st); err != nil {
+			return err
+		}
+	}
+
+	authors, years := make(map[string]bool), make(map[string]bool)
+	for _, st := range s.studies {
+		authors[st.Author] = true
+		if st.Year != "" {
+			years[st.Year] = true
+		}
+	}
+	index := struct {
+		Studies        []*siteStudy
+		Authors, Years []string
+	}{s.studies, sortedKeys(authors), sortedKeys(years)}
+	return writeTemplate(filepath.Join(s.dir, "index.html"), indexPage, index)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeTemplate(fname string, t *template.Template, data interface{}) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+const siteStyle = `<style>
+body { font-family: sans-serif; margin: 2em; background: #f4ecdf; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.8em; text-align: left; }
+th { cursor: pointer; border-bottom: 1px solid; }
+tr:nth-child(even) { background: #ebdcc4; }
+.moves { max-width: 40em; line-height: 1.6; }
+.num { color: #777; }
+.move { font-weight: bold; }
+.variation .move { font-weight: normal; }
+.variation { color: #444; }
+</style>`
+
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Studies</title>
+` + siteStyle + `
+</head>
+<body>
+<h1>Studies</h1>
+<p>
+<select id="result"><option value="">All results</option><option>Win</option><option>Draw</option></select>
+<select id="author"><option value="">All authors</option>{{range .Authors}}<option>{{.}}</option>{{end}}</select>
+<select id="year"><option value="">All years</option>{{range .Years}}<option>{{.}}</option>{{end}}</select>
+<span id="count"></span>
+</p>
+<table id="studies">
+<thead><tr><th data-key="sig">Study</th><th data-key="author">Author</th><th data-key="year">Year</th><th data-key="result">Result</th><th>GBR</th><th>Summary</th><th>Lines</th></tr></thead>
+<tbody>
+{{range .Studies}}<tr data-sig="{{.Sig}}" data-author="{{.Author}}" data-year="{{.Year}}" data-result="{{.Result}}"><td><a href="{{.Sig}}.html">{{.Sig}}</a></td><td>{{.Author}}</td><td>{{or .Year "?"}}</td><td>{{.Result}}</td><td>{{.GBR}}</td><td>{{.Summary}}</td><td>{{.Variations}}/{{.TotalVariations}}</td></tr>
+{{end}}</tbody>
+</table>
+<script>
+(function() {
+	var body = document.querySelector('#studies tbody');
+	var rows = Array.prototype.slice.call(body.rows);
+	var filters = ['result', 'author', 'year'].map(function(k) { return document.getElementById(k); });
+	function filter() {
+		var n = 0;
+		rows.forEach(function(row) {
+			var show = filters.every(function(f) { return f.value === '' || row.dataset[f.id] === f.value; });
+			row.style.display = show ? '' : 'none';
+			if (show) n++;
+		});
+		document.getElementById('count').textContent = n + ' of ' + rows.length;
+	}
+	filters.forEach(function(f) { f.addEventListener('change', filter); });
+	var sortKey = 'sig', ascending = true;
+	document.querySelectorAll('th[data-key]').forEach(function(th) {
+		th.addEventListener('click', function() {
+			ascending = th.dataset.key === sortKey ? !ascending : true;
+			sortKey = th.dataset.key;
+			rows.sort(function(a, b) {
+				var x = a.dataset[sortKey], y = b.dataset[sortKey];
+				// studies without a year go last either way
+				if (x === '' || y === '') return (x === '') - (y === '');
+				return (x < y ? -1 : x > y ? 1 : 0) * (ascending ? 1 : -1);
+			});
+			rows.forEach(function(row) { body.appendChild(row); });
+		});
+	});
+	filter();
+})();
+</script>
+</body>
+</html>
+`))
+
+var studyPage = template.Must(template.New("study").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Author}}{{with .Year}} {{.}}{{end}}</title>
+` + siteStyle + `
+</head>
+<body>
+<p><a href="index.html">Index</a>{{if .Prev}} | <a href="{{.Prev}}">Previous</a>{{end}}{{if .Next}} | <a href="{{.Next}}">Next</a>{{end}}</p>
+<h1>{{.Author}}</h1>
+<p>{{if .Source}}{{.Source}}, {{end}}{{or .Year "?"}}. {{.Summary}}, GBR {{.GBR}}</p>
+<p><img src="{{.Diagram}}" alt="{{.Summary}}">{{if .GIF}} <img src="{{.GIF}}" alt="The solution">{{end}}</p>
+<div class="moves">{{.Moves}}</div>
+<p>{{.TotalVariations}} lines, {{.Variations}} of them from the main line.
+<a href="{{.Lichess}}">Analyse on lichess</a> | <a href="{{.PGN}}">PGN</a></p>
+</body>
+</html>
+`))
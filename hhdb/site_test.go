@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSiteLink(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		dir, p, want string
+	}{
+		{"site", "./pgn/a.pgn", "../pgn/a.pgn"},
+		{"out/site", "./jpg/a.jpg", "../../jpg/a.jpg"},
+		{".", "./pgn/a.pgn", "pgn/a.pgn"},
+		{filepath.Join(wd, "site"), "./pgn/a.pgn", "../pgn/a.pgn"},
+		{filepath.Join(wd, "out", "site"), "gif/a.gif", "../../gif/a.gif"},
+		{"site", "/data/gif/a.gif", "file:///data/gif/a.gif"},
+	} {
+		s := &site{dir: c.dir}
+		if got := s.link(c.p); got != c.want {
+			t.Errorf("link of %s from %s is %s, want %s", c.p, c.dir, got, c.want)
+		}
+	}
+}
@@ -1,50 +1,277 @@
-
 package main
 
 import (
-	"errors"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+
 	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
 )
 
-var ErrGamesLimit = errors.New("too much games")
+// Problem is something wrong with a game. Offset is the byte offset in
+// the input of the game or, for a move, of the move.
+type Problem struct {
+	File   string `json:"file"`
+	Game   int    `json:"game"`
+	Offset int    `json:"offset"`
+	Event  string `json:"event"`
+	White  string `json:"white"`
+	Black  string `json:"black"`
+	Check  string `json:"check"` // parse, tags, result, fen or move
+	Ply    int    `json:"ply,omitempty"`
+	SAN    string `json:"san,omitempty"`
+	Line   string `json:"line,omitempty"` // main or variation
+	Msg    string `json:"message"`
+}
 
-func main() {
-	parsePGN(os.Stdin, 50)
-}
-
-func parsePGN(pgnReader io.Reader, limit int) error {
-	parser := gochess.NewParser(pgnReader)
-	var err error
-	var pgngame *gochess.Game
-	ngames := 0
-	for {
-		if pgngame, err = parser.NextGame(); err == nil && pgngame != nil  {
-			ngames++;
-//			log.Printf("%s", pgngame.PGNText)
-			if err = pgngame.ParseMovesText(); err == nil {
-				board := gochess.NewBoard()
-				for _, ply := range pgngame.Moves.Plies {
-					if err = board.MakeMove(ply.SAN); err != nil {
-						log.Printf("Move Error: %s", err)
-						return err
-					}
-				}
-				if ngames >= limit {
-					return ErrGamesLimit
-				}
-			}
-			log.Println("Parsed", pgngame.Tags["White"], " - ", pgngame.Tags["Black"])
-		}
-		if err != nil || pgngame == nil {
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s:%d: game %d (%s: %s - %s): %s: ", p.File, p.Offset, p.Game, p.Event, p.White, p.Black, p.Check)
+	if p.SAN != "" {
+		s += fmt.Sprintf("%s in the %s line: ", moveText(p.Ply, p.SAN), p.Line)
+	}
+	return s + p.Msg
+}
+
+// moveText writes ply 1 as 1. and ply 2 as 1... before the move.
+func moveText(ply int, san string) string {
+	if ply%2 == 1 {
+		return fmt.Sprintf("%d. %s", (ply+1)/2, san)
+	}
+	return fmt.Sprintf("%d... %s", ply/2, san)
+}
+
+// checker validates the games of one input.
+type checker struct {
+	file     string
+	data     []byte
+	offset   int // where the next game is looked for
+	problems []Problem
+}
+
+// movetextCursor finds the moves of a game in its text in the order they
+// are written, skipping comments, so each move gets its own offset.
+type movetextCursor struct {
+	text []byte
+	pos  int
+}
+
+func (c *movetextCursor) find(san string) int {
+	from := c.pos
+	for c.pos < len(c.text) {
+		switch ch := c.text[c.pos]; {
+		case ch == '{':
+			if i := bytes.IndexByte(c.text[c.pos:], '}'); i >= 0 {
+				c.pos += i + 1
+			} else {
+				c.pos = len(c.text)
+			}
+		case ch == ';':
+			if i := bytes.IndexByte(c.text[c.pos:], '\n'); i >= 0 {
+				c.pos += i + 1
+			} else {
+				c.pos = len(c.text)
+			}
+		case strings.IndexByte(" \t\r\n()", ch) >= 0:
+			c.pos++
+		default:
+			start := c.pos
+			for c.pos < len(c.text) && strings.IndexByte(" \t\r\n(){;", c.text[c.pos]) < 0 {
+				c.pos++
+			}
+			token := strings.TrimLeft(string(c.text[start:c.pos]), "0123456789.")
+			if token != "" && strings.HasPrefix(token, san) {
+				return start + len(c.text[start:c.pos]) - len(token)
+			}
+		}
+	}
+	c.pos = from
+	return -1
+}
+
+func (ck *checker) check(num int, game *gochess.Game) {
+	base := ck.offset
+	if i := bytes.Index(ck.data[ck.offset:], bytes.TrimSpace(game.PGNText)); i >= 0 {
+		base = ck.offset + i
+		ck.offset = base + len(bytes.TrimSpace(game.PGNText))
+	}
+	report := func(p Problem) {
+		p.File, p.Game, p.Event, p.White, p.Black = ck.file, num, game.Tags["Event"], game.Tags["White"], game.Tags["Black"]
+		if p.Offset == 0 {
+			p.Offset = base
+		}
+		ck.problems = append(ck.problems, p)
+	}
+
+	for _, tag := range chess.SevenTagRoster {
+		if _, ok := game.Tags[tag]; !ok {
+			report(Problem{Check: "tags", Msg: fmt.Sprintf("no %s tag", tag)})
+		}
+	}
+
+	if err := game.ParseMovesText(); err != nil {
+		report(Problem{Check: "parse", Msg: err.Error()})
+		return
+	}
+
+	// the termination marker ends the movetext
+	text := game.PGNText
+	movetextStart := 0
+	for _, line := range bytes.SplitAfter(text, []byte("\n")) {
+		if t := bytes.TrimSpace(line); len(t) > 0 && t[0] != '[' {
+			break
+		}
+		movetextStart += len(line)
+	}
+	movetext := text[movetextStart:]
+	fields := strings.Fields(string(movetext))
+	marker := ""
+	if len(fields) > 0 {
+		switch last := fields[len(fields)-1]; last {
+		case "1-0", "0-1", "1/2-1/2", "*":
+			marker = last
+		}
+	}
+	if result, ok := game.Tags["Result"]; ok {
+		switch {
+		case marker == "":
+			report(Problem{Check: "result", Msg: "no termination marker after the moves"})
+		case result != marker:
+			report(Problem{Check: "result", Msg: fmt.Sprintf("Result tag is %s but the moves end with %s", result, marker)})
+		}
+	}
+
+	p := chess.StartPosition()
+	fen, hasFEN := game.Tags["FEN"]
+	setup := game.Tags["SetUp"]
+	switch {
+	case hasFEN && setup != "1":
+		report(Problem{Check: "fen", Msg: "FEN tag without SetUp \"1\""})
+	case !hasFEN && setup == "1":
+		report(Problem{Check: "fen", Msg: "SetUp \"1\" without a FEN tag"})
+	}
+	if hasFEN {
+		var err error
+		if p, err = chess.ParseFEN(fen); err != nil {
+			report(Problem{Check: "fen", Msg: err.Error()})
+			return
+		}
+	}
+
+	cursor := &movetextCursor{text: movetext}
+	firstPly := 1
+	if p.Turn == chess.Black {
+		firstPly = 2
+	}
+	firstPly += 2 * (p.FullMoves - 1)
+	var walk func(p *chess.Position, v gochess.Variation, ply int, line string)
+	walk = func(p *chess.Position, v gochess.Variation, ply int, line string) {
+		for i, move := range v.Plies {
+			offset := base
+			if at := cursor.find(move.SAN); at >= 0 {
+				offset = base + movetextStart + at
+			}
+			m, err := p.ParseSAN(move.SAN)
+			next := p
+			if err == nil {
+				next = p.Play(m)
+			}
+			// the variations are alternatives to this move and are
+			// written after it
+			for _, alt := range move.Variations {
+				walk(p, alt, ply+i, "variation")
+			}
+			if err != nil {
+				report(Problem{Check: "move", Offset: offset, Ply: ply + i, SAN: move.SAN, Line: line, Msg: err.Error()})
+				return
+			}
+			p = next
+		}
+	}
+	walk(p, game.Moves, firstPly, "main")
+}
+
+func (ck *checker) run(limit int) error {
+	parser := gochess.NewParser(bytes.NewReader(ck.data))
+	for num := 1; limit == 0 || num <= limit; num++ {
+		game, err := parser.NextGame()
+		if err != nil {
+			ck.problems = append(ck.problems, Problem{File: ck.file, Game: num, Offset: ck.offset, Check: "parse", Msg: err.Error()})
+			return err
+		}
+		if game == nil {
 			break
 		}
+		ck.check(num, game)
 	}
-	if err != nil {
-		log.Printf("PGN parser error: game %d error \"%s\"", ngames, err)
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	format := flag.String("format", "text", "report format: text or json")
+	limit := flag.Int("limit", 0, "games to check in each file, all if 0")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pgncheck [-format text|json] [-limit n] [file.pgn...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *format != "text" && *format != "json" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var problems []Problem
+	for _, file := range files {
+		var data []byte
+		var err error
+		if file == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+			file = "stdin"
+		} else {
+			data, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+		ck := &checker{file: file, data: data}
+		ck.run(*limit)
+		problems = append(problems, ck.problems...)
 	}
-	return err
 
+	if err := writeReport(os.Stdout, *format, problems); err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func writeReport(w io.Writer, format string, problems []Problem) error {
+	if format == "json" {
+		if problems == nil {
+			problems = []Problem{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(problems)
+	}
+	for _, p := range problems {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// annotator marks moves by how much they drop the mover's win
+// probability, as estimated by the engine, and shows the engine's line
+// after each marked move.
+type annotator struct {
+	pool    *EnginePool
+	limits  SearchLimits
+	engine  string
+	pvPlies int
+
+	// moves in the book are not judged and their positions are not
+	// searched
+	book      *Book
+	bookPlies int
+
+	inaccuracy, mistake, blunder float64
+}
+
+func (a *annotator) judge(drop float64) string {
+	switch {
+	case drop >= a.blunder:
+		return "??"
+	case drop >= a.mistake:
+		return "?"
+	case drop >= a.inaccuracy:
+		return "?!"
+	}
+	return ""
+}
+
+func pgnVariations(vs []gochess.Variation) [][]pgnMove {
+	var moves [][]pgnMove
+	for _, v := range vs {
+		var line []pgnMove
+		for _, ply := range v.Plies {
+			line = append(line, pgnMove{SAN: ply.SAN, Variations: pgnVariations(ply.Variations)})
+		}
+		moves = append(moves, line)
+	}
+	return moves
+}
+
+// bestLine is the engine's variation in pos as SAN, with its score.
+func (a *annotator) bestLine(pos *chess.Position, v UCIVariation) []pgnMove {
+	var line []pgnMove
+	for _, san := range v.SAN {
+		if len(line) == a.pvPlies {
+			break
+		}
+		line = append(line, pgnMove{SAN: san})
+	}
+	if len(line) > 0 {
+		line[0].Comment = pgnEval(v.Score, pos.Turn)
+	}
+	return line
+}
+
+func (a *annotator) inBook(ply int, pos *chess.Position, uci string) bool {
+	if a.book == nil || ply >= a.bookPlies {
+		return false
+	}
+	for _, bm := range a.book.Moves(pos) {
+		if bm.Move.String() == uci {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *annotator) annotate(ctx context.Context, game *gochess.Game) (*pgnGame, error) {
+	start := chess.StartPosition()
+	fen := "startpos"
+	if game.Tags["FEN"] != "" {
+		var err error
+		if start, err = chess.ParseFEN(game.Tags["FEN"]); err != nil {
+			return nil, err
+		}
+		fen = start.FEN()
+	}
+
+	positions := []*chess.Position{start}
+	var ucis []string
+	var moves []pgnMove
+	for i, ply := range game.Moves.Plies {
+		pos := positions[i]
+		m, err := pos.ParseSAN(ply.SAN)
+		if err != nil {
+			return nil, fmt.Errorf("ply %d: %v", i+1, err)
+		}
+		moves = append(moves, pgnMove{SAN: pos.SAN(m), Variations: pgnVariations(ply.Variations)})
+		ucis = append(ucis, m.String())
+		positions = append(positions, pos.Play(m))
+	}
+
+	var jobs []UCIPosition
+	var plies []int
+	for i, pos := range positions {
+		if i < len(ucis) && a.inBook(i, pos, ucis[i]) {
+			continue
+		}
+		if len(pos.LegalMoves()) > 0 {
+			jobs = append(jobs, UCIPosition{FEN: fen, Moves: ucis[:i]})
+			plies = append(plies, i)
+		}
+	}
+	results := a.pool.EvaluateAll(ctx, jobs, a.limits)
+	best := make([]*UCIVariation, len(positions))
+	for k := range results {
+		if results[k].Err != nil {
+			return nil, fmt.Errorf("ply %d: %v", plies[k], results[k].Err)
+		}
+		if vs := results[k].Eval.Variations; len(vs) > 0 {
+			best[plies[k]] = &vs[0]
+		}
+	}
+
+	for i := range moves {
+		next := positions[i+1]
+		var after float64 // the mover's win probability after the move
+		switch {
+		case best[i+1] != nil:
+			moves[i].Comment = pgnEval(best[i+1].Score, next.Turn)
+			after = 1 - best[i+1].Score.WinProbability()
+		case next.IsCheckmate():
+			after = 1
+		case next.IsStalemate():
+			after = 0.5
+		default:
+			continue
+		}
+		if best[i] == nil || (len(best[i].Moves) > 0 && best[i].Moves[0] == ucis[i]) {
+			continue
+		}
+		if moves[i].NAG = a.judge(best[i].Score.WinProbability() - after); moves[i].NAG != "" {
+			if line := a.bestLine(positions[i], *best[i]); len(line) > 0 {
+				moves[i].Variations = append(moves[i].Variations, line)
+			}
+		}
+	}
+
+	tags := make(map[string]string)
+	for k, v := range game.Tags {
+		tags[k] = v
+	}
+	tags["Annotator"] = a.engine
+	result := game.Tags["Result"]
+	if result == "" {
+		result = "*"
+	}
+	return &pgnGame{Tags: tags, Start: start, Moves: moves, Result: result}, nil
+}
+
+func annotateCmd(args []string) {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	var ef engineFlags
+	ef.register(fs, 1000)
+	var a annotator
+	fs.IntVar(&a.pvPlies, "pv", 8, "plies of the engine's line to show at mistakes")
+	fs.Float64Var(&a.inaccuracy, "inaccuracy", 0.05, "win probability drop of an inaccuracy (?!)")
+	fs.Float64Var(&a.mistake, "mistake", 0.10, "win probability drop of a mistake (?)")
+	fs.Float64Var(&a.blunder, "blunder", 0.15, "win probability drop of a blunder (??)")
+	output := fs.String("o", "", "output file, stdout if empty")
+	var bf bookFlags
+	bf.register(fs)
+	fs.Parse(args)
+
+	var fin io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal("Failed to open: ", err)
+		}
+		defer f.Close()
+		fin = f
+	}
+	var fout io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("Failed to create: ", err)
+		}
+		defer f.Close()
+		fout = f
+	}
+
+	var err error
+	if a.book, err = bf.open(); err != nil {
+		log.Fatal(err)
+	}
+	a.bookPlies = bf.plies
+	pool, err := ef.pool()
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	defer pool.Close()
+	a.pool = pool
+	a.limits = ef.searchLimits(fs)
+	a.engine = pool.Info().Name
+
+	ngame := 0
+	parser := gochess.NewParser(fin)
+	for {
+		game, err := parser.NextGame()
+		if err != nil {
+			log.Fatal("Failed to parse: ", err)
+		}
+		if game == nil {
+			break
+		}
+		ngame++
+		if err := game.ParseMovesText(); err != nil {
+			log.Println("Failed to parse game", ngame, err)
+			fout.Write(game.PGNText)
+			continue
+		}
+		annotated, err := a.annotate(context.Background(), game)
+		if err != nil {
+			log.Println("Failed to annotate game", ngame, err)
+			fout.Write(game.PGNText)
+			continue
+		}
+		if err := annotated.Write(fout); err != nil {
+			log.Fatal("Failed to write: ", err)
+		}
+		log.Println("Annotated game", ngame, game.Tags["White"], "-", game.Tags["Black"])
+	}
+}
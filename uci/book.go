@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/anastasop/gochess"
+	"github.com/anastasop/oneshot/chess"
+)
+
+// Book is a Polyglot opening book. The file is a sorted array of
+// 16 byte big endian entries: the position key, the move, its weight
+// and 4 bytes of learning data we ignore. It is small enough to read
+// into memory.
+type Book struct {
+	entries []bookEntry
+}
+
+type bookEntry struct {
+	Key    uint64
+	Move   uint16
+	Weight uint16
+	Learn  uint32
+}
+
+type BookMove struct {
+	Move   chess.Move
+	Weight int
+}
+
+func OpenBook(path string) (*Book, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size()%16 != 0 {
+		return nil, fmt.Errorf("%s is not a polyglot book", path)
+	}
+	b := &Book{entries: make([]bookEntry, fi.Size()/16)}
+	if err := binary.Read(bufio.NewReader(f), binary.BigEndian, b.entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return b, nil
+}
+
+// Moves are the book moves in p, heaviest first. Moves that are not
+// legal, from a bad book or a key collision, are skipped.
+func (b *Book) Moves(p *chess.Position) []BookMove {
+	key := p.PolyglotKey()
+	i := sort.Search(len(b.entries), func(i int) bool { return b.entries[i].Key >= key })
+	var moves []BookMove
+	for ; i < len(b.entries) && b.entries[i].Key == key; i++ {
+		if m, err := p.ParsePolyglotMove(b.entries[i].Move); err == nil {
+			moves = append(moves, BookMove{m, int(b.entries[i].Weight)})
+		}
+	}
+	sort.SliceStable(moves, func(i, j int) bool { return moves[i].Weight > moves[j].Weight })
+	return moves
+}
+
+// Pick chooses a book move in p, at random by weight or the heaviest.
+func (b *Book) Pick(p *chess.Position, random bool) (chess.Move, bool) {
+	moves := b.Moves(p)
+	total := 0
+	for _, bm := range moves {
+		total += bm.Weight
+	}
+	if total == 0 {
+		return chess.Move{}, false
+	}
+	if !random {
+		return moves[0].Move, true
+	}
+	n := rand.Intn(total)
+	for _, bm := range moves {
+		if n -= bm.Weight; n < 0 {
+			return bm.Move, true
+		}
+	}
+	return moves[0].Move, true
+}
+
+// Line follows the book from p for at most plies moves, in UCI.
+func (b *Book) Line(p *chess.Position, plies int, random bool) []string {
+	var line []string
+	for len(line) < plies {
+		m, ok := b.Pick(p, random)
+		if !ok {
+			break
+		}
+		line = append(line, m.String())
+		p = p.Play(m)
+	}
+	return line
+}
+
+// bookBuilder counts the results of the moves played in games. The
+// weight of a move is twice its wins plus its draws for the side that
+// played it, as Polyglot's make-book does.
+type bookBuilder struct {
+	plies    int
+	minGames int
+	moves    map[uint64]map[uint16]*bookCount
+}
+
+type bookCount struct {
+	games, score int
+}
+
+func (bb *bookBuilder) add(game *gochess.Game) error {
+	var score [2]int // for a win, by color
+	switch game.Tags["Result"] {
+	case "1-0":
+		score = [2]int{2, 0}
+	case "0-1":
+		score = [2]int{0, 2}
+	case "1/2-1/2":
+		score = [2]int{1, 1}
+	default:
+		return nil
+	}
+	p := chess.StartPosition()
+	if fen := game.Tags["FEN"]; fen != "" {
+		var err error
+		if p, err = chess.ParseFEN(fen); err != nil {
+			return err
+		}
+	}
+	for i, ply := range game.Moves.Plies {
+		if i == bb.plies {
+			break
+		}
+		m, err := p.ParseSAN(ply.SAN)
+		if err != nil {
+			return fmt.Errorf("ply %d: %v", i+1, err)
+		}
+		key := p.PolyglotKey()
+		if bb.moves[key] == nil {
+			bb.moves[key] = make(map[uint16]*bookCount)
+		}
+		v := p.PolyglotMove(m)
+		if bb.moves[key][v] == nil {
+			bb.moves[key][v] = new(bookCount)
+		}
+		bb.moves[key][v].games++
+		bb.moves[key][v].score += score[p.Turn]
+		p = p.Play(m)
+	}
+	return nil
+}
+
+// write writes the book, scaling the weights of a position down if they
+// do not fit in 16 bits. Moves that never scored are left out.
+func (bb *bookBuilder) write(w io.Writer) (int, error) {
+	var entries []bookEntry
+	for key, moves := range bb.moves {
+		max := 0
+		for _, c := range moves {
+			if c.score > max {
+				max = c.score
+			}
+		}
+		for v, c := range moves {
+			if c.games < bb.minGames || c.score == 0 {
+				continue
+			}
+			weight := c.score
+			if max > 0xffff {
+				weight = int(int64(c.score) * 0xffff / int64(max))
+				if weight == 0 {
+					weight = 1
+				}
+			}
+			entries = append(entries, bookEntry{Key: key, Move: v, Weight: uint16(weight)})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Weight > entries[j].Weight
+	})
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.BigEndian, entries); err != nil {
+		return 0, err
+	}
+	return len(entries), bw.Flush()
+}
+
+func bookCmd(args []string) {
+	fs := flag.NewFlagSet("book", flag.ExitOnError)
+	output := fs.String("o", "", "book to build from the pgn files")
+	probe := fs.String("probe", "", "book to show the moves of the fen arguments from, the start position if none")
+	bb := &bookBuilder{moves: make(map[uint64]map[uint16]*bookCount)}
+	fs.IntVar(&bb.plies, "plies", 30, "plies of each game to put in the book")
+	fs.IntVar(&bb.minGames, "min", 1, "games a move must be played in")
+	fs.Parse(args)
+
+	if *probe != "" {
+		b, err := OpenBook(*probe)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fens := fs.Args()
+		if len(fens) == 0 {
+			fens = []string{chess.StartFEN}
+		}
+		for _, fen := range fens {
+			p, err := chess.ParseFEN(fen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s key %016x\n", fen, p.PolyglotKey())
+			for _, bm := range b.Moves(p) {
+				fmt.Printf("%8s %6d\n", p.SAN(bm.Move), bm.Weight)
+			}
+		}
+		return
+	}
+
+	if *output == "" || fs.NArg() == 0 {
+		log.Fatal("usage: uci book -o book.bin games.pgn... | uci book -probe book.bin [fen...]")
+	}
+	ngame := 0
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal("Failed to open: ", err)
+		}
+		parser := gochess.NewParser(f)
+		for {
+			game, err := parser.NextGame()
+			if err != nil {
+				log.Fatal("Failed to parse: ", err)
+			}
+			if game == nil {
+				break
+			}
+			ngame++
+			if err := game.ParseMovesText(); err != nil {
+				log.Println("Failed to parse game", ngame, err)
+				continue
+			}
+			if err := bb.add(game); err != nil {
+				log.Println("Skipped game", ngame, game.Tags["White"], "-", game.Tags["Black"], err)
+			}
+		}
+		f.Close()
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal("Failed to create: ", err)
+	}
+	n, err := bb.write(f)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		log.Fatal("Failed to write: ", err)
+	}
+	log.Println("Wrote", n, "entries from", ngame, "games to", *output)
+}
+
+// bookFlags are the flags of the commands that use a book: match plays
+// its moves and annotate does not judge them. Random is only for the
+// commands that play, which register it themselves.
+type bookFlags struct {
+	path   string
+	plies  int
+	random bool
+}
+
+func (bf *bookFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&bf.path, "polyglot", "", "polyglot opening book, none if empty")
+	fs.IntVar(&bf.plies, "book-plies", 16, "plies of a game to use the book for at most")
+}
+
+func (bf *bookFlags) open() (*Book, error) {
+	if bf.path == "" {
+		return nil, nil
+	}
+	return OpenBook(bf.path)
+}
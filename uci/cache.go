@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// EvalCache keeps evaluations on disk across runs. Entries are keyed by
+// engine name, as the engine reports it with its version, the settings of
+// its options, as UCIEngine.Settings tells, and position.
+// A cached evaluation answers any search it is at least as deep as.
+//
+// The file has one JSON entry per line, least recently used first. It is
+// read by OpenEvalCache and rewritten by Save.
+type EvalCache struct {
+	sync.Mutex
+	path    string
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used at front
+	dirty   bool
+}
+
+type cacheEntry struct {
+	Engine   string                `json:"engine"`
+	Settings string                `json:"settings,omitempty"`
+	FEN      string                `json:"fen"`
+	Limits   SearchLimits          `json:"limits"`
+	Eval     UCIPositionEvaluation `json:"eval"`
+}
+
+func cacheKey(engine, settings, fen string) string {
+	return engine + "|" + settings + "|" + fen
+}
+
+func (e *cacheEntry) key() string {
+	return cacheKey(e.Engine, e.Settings, e.FEN)
+}
+
+func (e *cacheEntry) depth() int {
+	if len(e.Eval.Variations) == 0 {
+		return 0
+	}
+	return e.Eval.Variations[0].Depth
+}
+
+// covers reports whether the entry is as good as searching with limits.
+func (e *cacheEntry) covers(limits SearchLimits) bool {
+	if len(e.Eval.Variations) == 0 || len(e.Eval.Variations) < limits.MultiPV {
+		return false
+	}
+	switch {
+	case limits.Depth > 0:
+		return e.depth() >= limits.Depth
+	case limits.Nodes > 0:
+		return e.Eval.Variations[0].Nodes >= limits.Nodes
+	case limits.MoveTime > 0:
+		return e.Limits.Depth == 0 && e.Limits.Nodes == 0 && e.Limits.MoveTime >= limits.MoveTime
+	}
+	return false
+}
+
+// cacheable reports whether a search ends by one of depth, nodes or
+// movetime, the limits we can compare entries by. A search by depth or
+// nodes may have a movetime too, that only bounds how long it takes; the
+// result tells the depth and nodes it got to.
+func cacheable(limits SearchLimits) bool {
+	if len(limits.SearchMoves) > 0 || limits.Ponder || limits.Infinite || limits.Mate > 0 ||
+		limits.WTime > 0 || limits.BTime > 0 {
+		return false
+	}
+	switch {
+	case limits.Depth > 0 && limits.Nodes > 0:
+		return false
+	case limits.Depth > 0 || limits.Nodes > 0:
+		return true
+	}
+	return limits.MoveTime > 0
+}
+
+// OpenEvalCache reads the cache at path, which may not exist yet. The
+// cache keeps at most max entries and drops the least recently used.
+func OpenEvalCache(path string, max int) (*EvalCache, error) {
+	c := &EvalCache{path: path, max: max, entries: make(map[string]*list.Element), lru: list.New()}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		e := new(cacheEntry)
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		c.put(e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	c.dirty = false
+	return c, nil
+}
+
+func (c *EvalCache) put(e *cacheEntry) {
+	if el, ok := c.entries[e.key()]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key()] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		old := c.lru.Back()
+		c.lru.Remove(old)
+		delete(c.entries, old.Value.(*cacheEntry).key())
+	}
+	c.dirty = true
+}
+
+func (c *EvalCache) Get(engine, settings string, pos UCIPosition, limits SearchLimits) (UCIPositionEvaluation, bool) {
+	if !cacheable(limits) {
+		return UCIPositionEvaluation{}, false
+	}
+	p, err := pos.Validate()
+	if err != nil {
+		return UCIPositionEvaluation{}, false
+	}
+	fen := p.Key()
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[cacheKey(engine, settings, fen)]
+	if !ok {
+		return UCIPositionEvaluation{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !e.covers(limits) {
+		return UCIPositionEvaluation{}, false
+	}
+	// the order of use alone is not worth rewriting the file for
+	c.lru.MoveToFront(el)
+	eval := e.Eval
+	// a search without MultiPV gets one line, as from the engine
+	n := limits.MultiPV
+	if n <= 0 {
+		n = 1
+	}
+	eval.Variations = eval.Variations[:n]
+	// older cache files have no SAN
+	eval.Variations = append([]UCIVariation(nil), eval.Variations...)
+	for i := range eval.Variations {
+		eval.Variations[i].SAN = sanLine(p, eval.Variations[i].Moves)
+	}
+	return eval, true
+}
+
+// Put stores an evaluation unless a deeper one is already cached.
+func (c *EvalCache) Put(engine, settings string, pos UCIPosition, limits SearchLimits, eval UCIPositionEvaluation) {
+	if !cacheable(limits) || len(eval.Variations) == 0 {
+		return
+	}
+	p, err := pos.Validate()
+	if err != nil {
+		return
+	}
+	e := &cacheEntry{Engine: engine, Settings: settings, FEN: p.Key(), Limits: limits, Eval: eval}
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[e.key()]; ok {
+		old := el.Value.(*cacheEntry)
+		if old.depth() > e.depth() && len(old.Eval.Variations) >= len(e.Eval.Variations) {
+			return
+		}
+	}
+	c.put(e)
+}
+
+// Invalidate drops the entries of an engine and returns how many.
+func (c *EvalCache) Invalidate(engine string) int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if el.Value.(*cacheEntry).Engine == engine {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	if n > 0 {
+		c.dirty = true
+	}
+	return n
+}
+
+// Engines counts the entries of each engine.
+func (c *EvalCache) Engines() map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	engines := make(map[string]int)
+	for _, el := range c.entries {
+		engines[el.Value.(*cacheEntry).Engine]++
+	}
+	return engines
+}
+
+// Save rewrites the cache file if entries changed.
+func (c *EvalCache) Save() error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		if err := enc.Encode(el.Value); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func cacheCmd(args []string) {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	path := fs.String("cache", "evals.cache", "cache file")
+	invalidate := fs.String("invalidate", "", "drop the entries of this engine, as in its 'id name'")
+	fs.Parse(args)
+
+	c, err := OpenEvalCache(*path, int(^uint(0)>>1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *invalidate != "" {
+		log.Println("Dropped", c.Invalidate(*invalidate), "entries")
+		if err := c.Save(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	engines := c.Engines()
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%8d %s\n", engines[name], name)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEvalCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "evals.cache")
+	c, err := OpenEvalCache(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := UCIPosition{FEN: "startpos", Moves: []string{"e2e4"}}
+	eval := UCIPositionEvaluation{BestMove: "e7e5", Variations: []UCIVariation{{Depth: 12, Moves: []string{"e7e5"}}}}
+	c.Put("Engine 1", "", pos, SearchLimits{Depth: 12}, eval)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []struct {
+		engine, settings string
+		limits           SearchLimits
+		hit              bool
+	}{
+		{"Engine 1", "", SearchLimits{Depth: 10}, true},
+		{"Engine 1", "", SearchLimits{Depth: 14}, false},
+		{"Engine 1", "", SearchLimits{Depth: 10, WTime: 1000}, false},
+		{"Engine 1", "", SearchLimits{Depth: 12, MoveTime: 10000}, true},
+		{"Engine 1", "", SearchLimits{MoveTime: 100}, false},
+		{"Engine 1", "a1b2c3", SearchLimits{Depth: 10}, false},
+		{"Engine 2", "", SearchLimits{Depth: 10}, false},
+	} {
+		got, ok := c.Get(m.engine, m.settings, pos, m.limits)
+		if ok != m.hit {
+			t.Errorf("Get(%s, %q, %+v) hit is %v, want %v", m.engine, m.settings, m.limits, ok, m.hit)
+		} else if ok && (got.BestMove != "e7e5" || len(got.Variations[0].SAN) != 1 || got.Variations[0].SAN[0] != "e5") {
+			t.Errorf("Get(%s, %q, %+v) = %+v", m.engine, m.settings, m.limits, got)
+		}
+	}
+	if c.dirty {
+		t.Error("cache is dirty after Get")
+	}
+
+	c, err = OpenEvalCache(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("Engine 1", "", pos, SearchLimits{Depth: 12}); !ok {
+		t.Error("saved entry is not read back")
+	}
+
+	// a search that does not ask for more lines gets one
+	pos = UCIPosition{FEN: "startpos"}
+	eval.Variations = []UCIVariation{{Rank: 1, Depth: 12, Moves: []string{"e2e4"}}, {Rank: 2, Depth: 12, Moves: []string{"d2d4"}}}
+	c.Put("Engine 1", "", pos, SearchLimits{Depth: 12, MultiPV: 2}, eval)
+	for multiPV, lines := range []int{1, 1, 2} {
+		if got, _ := c.Get("Engine 1", "", pos, SearchLimits{Depth: 12, MultiPV: multiPV}); len(got.Variations) != lines {
+			t.Errorf("MultiPV %d gets %d lines, want %d", multiPV, len(got.Variations), lines)
+		}
+	}
+}
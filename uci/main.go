@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// optionsFlag collects repeated -option name=value flags.
+type optionsFlag map[string]string
+
+func (o optionsFlag) String() string {
+	var opts []string
+	for k, v := range o {
+		opts = append(opts, k+"="+v)
+	}
+	sort.Strings(opts)
+	return strings.Join(opts, ",")
+}
+
+func (o optionsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return fmt.Errorf("option '%s' is not name=value", s)
+	}
+	o[s[:i]] = s[i+1:]
+	return nil
+}
+
+// engineFlags are the flags of every command that runs an engine.
+type engineFlags struct {
+	path    string
+	options optionsFlag
+	jobs    int
+	limits  SearchLimits
+
+	cache     string
+	cacheSize int
+	syzygy    string
+	fathom    string
+}
+
+func (ef *engineFlags) register(fs *flag.FlagSet, movetime int) {
+	ef.options = make(optionsFlag)
+	fs.StringVar(&ef.path, "engine", "/home/spyros/bin/stockfish", "engine executable")
+	fs.Var(ef.options, "option", "engine option as name=value, may be repeated")
+	fs.IntVar(&ef.jobs, "j", 1, "engines to run in parallel, one per cpu if 0")
+	fs.IntVar(&ef.limits.MoveTime, "movetime", movetime, "search time per position in msec")
+	fs.IntVar(&ef.limits.Depth, "depth", 0, "search depth per position")
+	fs.IntVar(&ef.limits.Nodes, "nodes", 0, "search nodes per position")
+	fs.IntVar(&ef.limits.MultiPV, "multipv", 0, "lines to search per position")
+	fs.StringVar(&ef.cache, "cache", "", "evaluation cache file, none if empty")
+	fs.IntVar(&ef.cacheSize, "cache-size", 1000000, "evaluations to keep in the cache")
+	fs.StringVar(&ef.syzygy, "syzygy", "", "directory of syzygy tables to answer endgames from, none if empty; needs fathom")
+	fs.StringVar(&ef.fathom, "fathom", "fathom", "fathom executable that probes the syzygy tables, built from apps/fathom.c of github.com/jdart1/Fathom")
+}
+
+// searchLimits drops the default movetime if another limit was given.
+func (ef *engineFlags) searchLimits(fs *flag.FlagSet) SearchLimits {
+	limits := ef.limits
+	movetime := false
+	fs.Visit(func(f *flag.Flag) {
+		movetime = movetime || f.Name == "movetime"
+	})
+	if !movetime && (limits.Depth > 0 || limits.Nodes > 0) {
+		limits.MoveTime = 0
+	}
+	return limits
+}
+
+func (ef *engineFlags) pool() (*EnginePool, error) {
+	var cache *EvalCache
+	if ef.cache != "" {
+		var err error
+		if cache, err = OpenEvalCache(ef.cache, ef.cacheSize); err != nil {
+			return nil, err
+		}
+	}
+	var tb *Tablebase
+	if ef.syzygy != "" {
+		var err error
+		if tb, err = OpenTablebase(ef.syzygy, ef.fathom); err != nil {
+			return nil, err
+		}
+	}
+	pool, err := NewEnginePool(ef.path, ef.options, ef.jobs)
+	if err != nil {
+		return nil, err
+	}
+	pool.Cache = cache
+	pool.Tablebase = tb
+	return pool, nil
+}
+
+func evalCmd(args []string) {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	var ef engineFlags
+	ef.register(fs, 5000)
+	fs.Parse(args)
+
+	fens := fs.Args()
+	if len(fens) == 0 {
+		fens = []string{"kbK5/pp6/1P6/8/8/8/8/R7 w - - 0 1"}
+	}
+	pool, err := ef.pool()
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	defer pool.Close()
+
+	positions := make([]UCIPosition, len(fens))
+	for i, fen := range fens {
+		positions[i] = UCIPosition{NewGame: true, FEN: fen}
+	}
+	for i, r := range pool.EvaluateAll(context.Background(), positions, ef.searchLimits(fs)) {
+		fmt.Println("Position:", fens[i])
+		if r.Err != nil {
+			fmt.Println("error: ", r.Err)
+			continue
+		}
+		for _, v := range r.Eval.Variations {
+			line := strings.Join(v.SAN, " ")
+			if len(v.SAN) < len(v.Moves) {
+				line += fmt.Sprint(" (illegal: ", strings.Join(v.Moves[len(v.SAN):], " "), ")")
+			}
+			fmt.Printf("Evaluation: score: %v variation: %s\n", v.Score, strings.TrimSpace(line))
+		}
+	}
+}
+
+var commands = map[string]func(args []string){
+	"eval":     evalCmd,
+	"annotate": annotateCmd,
+	"cache":    cacheCmd,
+	"book":     bookCmd,
+	"match":    matchCmd,
+	"serve":    serveCmd,
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatalf("usage: uci %s [flags] [args]", strings.Join(names, "|"))
+	}
+	commands[os.Args[1]](os.Args[2:])
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anastasop/oneshot/chess"
+)
+
+// engineSpec is an engine of a match given as path[,name=N][,Option=Value...].
+type engineSpec struct {
+	name    string
+	path    string
+	options map[string]string
+}
+
+type engineSpecs []*engineSpec
+
+func (es *engineSpecs) String() string {
+	var paths []string
+	for _, e := range *es {
+		paths = append(paths, e.path)
+	}
+	return strings.Join(paths, " ")
+}
+
+func (es *engineSpecs) Set(s string) error {
+	fields := strings.Split(s, ",")
+	e := &engineSpec{path: fields[0], options: make(map[string]string)}
+	for _, f := range fields[1:] {
+		i := strings.IndexByte(f, '=')
+		if i < 0 {
+			return fmt.Errorf("engine option '%s' is not name=value", f)
+		}
+		if f[:i] == "name" {
+			e.name = f[i+1:]
+		} else {
+			e.options[f[:i]] = f[i+1:]
+		}
+	}
+	*es = append(*es, e)
+	return nil
+}
+
+// adjudication ends games the engines agree on. A side resigns when both
+// engines scored it at -ResignScore or worse for ResignPlies plies in a
+// row, and a game is drawn after DrawMove if both scored it within
+// DrawScore for DrawPlies plies in a row. Zero plies disable each rule.
+type adjudication struct {
+	ResignScore, ResignPlies int
+	DrawMove, DrawScore      int
+	DrawPlies                int
+}
+
+type match struct {
+	engines  engineSpecs
+	openings []string
+	book     *Book
+	limits   SearchLimits // fixed limits, or the clock if WTime is set
+	margin   time.Duration
+	adjudication
+	bookFlags
+
+	sprt struct {
+		enabled     bool
+		elo0, elo1  float64
+		alpha, beta float64
+	}
+
+	mu      sync.Mutex
+	names   []string
+	results map[[2]int]*pairResult // by engine indices, lower first
+	pgn     *os.File
+	done    bool
+}
+
+type matchGame struct {
+	round        int
+	white, black int
+	opening      string
+	book         []string // moves from the book, the same for both colors
+}
+
+// pairResult counts the wins, draws and losses of the first engine of a
+// pair against the second.
+type pairResult struct {
+	W, D, L int
+}
+
+func (r *pairResult) add(result string, firstWhite bool) {
+	switch {
+	case result == "1/2-1/2":
+		r.D++
+	case (result == "1-0") == firstWhite:
+		r.W++
+	default:
+		r.L++
+	}
+}
+
+// Elo is the rating difference and the half width of its 95% interval.
+func (r *pairResult) Elo() (float64, float64) {
+	n := float64(r.W + r.D + r.L)
+	if n == 0 {
+		return 0, 0
+	}
+	s := (float64(r.W) + float64(r.D)/2) / n
+	variance := (float64(r.W)*(1-s)*(1-s) + float64(r.D)*(0.5-s)*(0.5-s) + float64(r.L)*s*s) / n
+	margin := 1.959964 * math.Sqrt(variance/n)
+	elo := func(s float64) float64 {
+		return -400 * math.Log10(1/s-1)
+	}
+	return elo(s), (elo(math.Min(s+margin, 0.9999)) - elo(math.Max(s-margin, 0.0001))) / 2
+}
+
+// LLR is the log likelihood ratio of elo1 over elo0 in the BayesElo model,
+// the same test cutechess-cli runs. The draw elo is estimated with half a
+// game added to each of W, D and L, so that it is defined before the
+// match has seen every result.
+func (r *pairResult) LLR(elo0, elo1 float64) float64 {
+	if r.W+r.D+r.L == 0 {
+		return 0
+	}
+	const prior = 0.5
+	n := float64(r.W+r.D+r.L) + 3*prior
+	w, l := (float64(r.W)+prior)/n, (float64(r.L)+prior)/n
+	drawElo := 200 * math.Log10((1-l)/l*(1-w)/w)
+	probs := func(elo float64) (win, draw, loss float64) {
+		win = 1 / (1 + math.Pow(10, (-elo+drawElo)/400))
+		loss = 1 / (1 + math.Pow(10, (elo+drawElo)/400))
+		return win, 1 - win - loss, loss
+	}
+	w0, d0, l0 := probs(elo0)
+	w1, d1, l1 := probs(elo1)
+	return float64(r.W)*math.Log(w1/w0) + float64(r.D)*math.Log(d1/d0) + float64(r.L)*math.Log(l1/l0)
+}
+
+// sprtResult is H1 or H0 if the test accepted one, or the empty string.
+func (m *match) sprtResult(r *pairResult) (string, float64) {
+	llr := r.LLR(m.sprt.elo0, m.sprt.elo1)
+	switch {
+	case llr >= math.Log((1-m.sprt.beta)/m.sprt.alpha):
+		return "H1", llr
+	case llr <= math.Log(m.sprt.beta/(1-m.sprt.alpha)):
+		return "H0", llr
+	}
+	return "", llr
+}
+
+// moveScore is the score the engine gave for its move, from white's
+// point of view, in centipawns with mates far beyond any.
+func moveScore(s Score, turn chess.Color) (int, bool) {
+	if s.Kind == ScoreNone {
+		return 0, false
+	}
+	v := s.key()
+	if turn == chess.Black {
+		v = -v
+	}
+	return v, true
+}
+
+// adjudicate looks at the white scores of the last plies.
+func (adj *adjudication) adjudicate(scores []int, fullMoves int) (string, string) {
+	all := func(n int, f func(int) bool) bool {
+		if n == 0 || len(scores) < n {
+			return false
+		}
+		for _, s := range scores[len(scores)-n:] {
+			if !f(s) {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case all(adj.ResignPlies, func(s int) bool { return s <= -adj.ResignScore }):
+		return "0-1", "adjudication"
+	case all(adj.ResignPlies, func(s int) bool { return s >= adj.ResignScore }):
+		return "1-0", "adjudication"
+	case fullMoves > adj.DrawMove && all(adj.DrawPlies, func(s int) bool { return s <= adj.DrawScore && s >= -adj.DrawScore }):
+		return "1/2-1/2", "adjudication"
+	}
+	return "", ""
+}
+
+func formatClock(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	secs := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%d:%02d:%06.3f", int(d.Hours()), int(d.Minutes())%60, secs)
+}
+
+// gameClock is the time each side has left. If MovesToGo is set the
+// control repeats: every MovesToGo moves of a side its base time is
+// added to its clock again.
+type gameClock struct {
+	base, inc, left [2]time.Duration
+	control         int
+	movesLeft       [2]int
+}
+
+func newGameClock(limits SearchLimits) *gameClock {
+	c := &gameClock{
+		base:    [2]time.Duration{time.Duration(limits.WTime) * time.Millisecond, time.Duration(limits.BTime) * time.Millisecond},
+		inc:     [2]time.Duration{time.Duration(limits.WInc) * time.Millisecond, time.Duration(limits.BInc) * time.Millisecond},
+		control: limits.MovesToGo,
+	}
+	c.left = c.base
+	c.movesLeft = [2]int{c.control, c.control}
+	return c
+}
+
+// limits sets the clocks, and the moves to the control, of side to move.
+func (c *gameClock) limits(limits SearchLimits, side chess.Color) SearchLimits {
+	limits.WTime, limits.BTime = int(c.left[0]/time.Millisecond), int(c.left[1]/time.Millisecond)
+	limits.MovesToGo = c.movesLeft[side]
+	return limits
+}
+
+// punch charges side with elapsed for a move and gives it the increment
+// and the time of a control it reached. It reports false if the side
+// ran out of time.
+func (c *gameClock) punch(side chess.Color, elapsed time.Duration) bool {
+	if c.left[side] -= elapsed; c.left[side] < 0 {
+		return false
+	}
+	c.left[side] += c.inc[side]
+	if c.control > 0 {
+		if c.movesLeft[side]--; c.movesLeft[side] == 0 {
+			c.left[side] += c.base[side]
+			c.movesLeft[side] = c.control
+		}
+	}
+	return true
+}
+
+// timeControl is the control in the form of the PGN TimeControl tag.
+func (c *gameClock) timeControl() string {
+	tc := fmt.Sprintf("%g+%g", c.base[0].Seconds(), c.inc[0].Seconds())
+	if c.control > 0 {
+		tc = fmt.Sprintf("%d/%s", c.control, tc)
+	}
+	return tc
+}
+
+// play plays one game and returns it with the reason it ended.
+func (m *match) play(ctx context.Context, g matchGame, engines []*UCIEngine, names []string) (*pgnGame, string) {
+	start, fen := chess.StartPosition(), "startpos"
+	if g.opening != "startpos" {
+		start, _ = chess.ParseFEN(g.opening)
+		fen = start.FEN()
+	}
+	players := [2]int{g.white, g.black}
+	clocked := m.limits.WTime > 0
+	clock := newGameClock(m.limits)
+
+	game := &pgnGame{Start: start, Tags: map[string]string{
+		"Event": "Engine match",
+		"Site":  "?",
+		"Date":  time.Now().Format("2006.01.02"),
+		"Round": fmt.Sprint(g.round),
+		"White": names[g.white],
+		"Black": names[g.black],
+	}}
+	if fen != "startpos" {
+		game.Tags["FEN"] = fen
+		game.Tags["SetUp"] = "1"
+	}
+	if clocked {
+		game.Tags["TimeControl"] = clock.timeControl()
+	}
+
+	pos := start
+	var moves []string
+	var scores []int
+	seen := map[string]int{pos.Key(): 1}
+	end := func(result, reason string) (*pgnGame, string) {
+		game.Result = result
+		game.Tags["Termination"] = reason
+		return game, reason
+	}
+	for _, uci := range g.book {
+		mv, _ := pos.ParseUCI(uci)
+		game.Moves = append(game.Moves, pgnMove{SAN: pos.SAN(mv), Comment: "book"})
+		moves = append(moves, uci)
+		pos = pos.Play(mv)
+		seen[pos.Key()]++
+	}
+	for ply := len(g.book); ; ply++ {
+		side := pos.Turn
+		eng := engines[players[side]]
+		won, lost := "1-0", "0-1"
+		if side == chess.Black {
+			won, lost = lost, won
+		}
+
+		limits := m.limits
+		sctx, cancel := ctx, context.CancelFunc(func() {})
+		if clocked {
+			limits = clock.limits(limits, side)
+			sctx, cancel = context.WithTimeout(ctx, clock.left[side]+m.margin)
+		}
+		began := time.Now()
+		a, err := eng.StartAnalysis(sctx, UCIPosition{NewGame: ply < len(g.book)+2, FEN: fen, Moves: moves}, limits)
+		var score Score
+		var depth int
+		var eval UCIPositionEvaluation
+		if err == nil {
+			for info := range a.Info {
+				if info.MultiPV == 1 && info.Score.Kind != ScoreNone {
+					score, depth = info.Score, info.Depth
+				}
+			}
+			eval, err = a.Wait()
+		}
+		elapsed := time.Since(began)
+		cancel()
+		if err != nil {
+			return end(lost, fmt.Sprintf("%s failed: %v", names[players[side]], err))
+		}
+		if clocked && !clock.punch(side, elapsed) {
+			return end(lost, "time forfeit")
+		}
+
+		mv, err := pos.ParseUCI(eval.BestMove)
+		if err != nil {
+			return end(lost, fmt.Sprintf("%s played an illegal move %s", names[players[side]], eval.BestMove))
+		}
+		comment := ""
+		if score.Kind != ScoreNone {
+			comment = strings.TrimSuffix(pgnEval(score, side), "]") + fmt.Sprintf(",%d] ", depth)
+		}
+		comment += fmt.Sprintf("[%%emt %s]", formatClock(elapsed))
+		if clocked {
+			comment += fmt.Sprintf(" [%%clk %s]", formatClock(clock.left[side]))
+		}
+		game.Moves = append(game.Moves, pgnMove{SAN: pos.SAN(mv), Comment: comment})
+		moves = append(moves, mv.String())
+		pos = pos.Play(mv)
+		seen[pos.Key()]++
+
+		switch {
+		case pos.IsCheckmate():
+			return end(won, "checkmate")
+		case pos.IsStalemate():
+			return end("1/2-1/2", "stalemate")
+		case pos.InsufficientMaterial():
+			return end("1/2-1/2", "insufficient material")
+		case pos.HalfMoves >= 100:
+			return end("1/2-1/2", "fifty moves")
+		case seen[pos.Key()] >= 3:
+			return end("1/2-1/2", "threefold repetition")
+		}
+		if s, ok := moveScore(score, side); ok {
+			scores = append(scores, s)
+		} else {
+			scores = scores[:0]
+		}
+		if result, reason := m.adjudicate(scores, pos.FullMoves); result != "" {
+			return end(result, reason)
+		}
+	}
+}
+
+// worker plays games with its own set of engine processes. If it cannot
+// start them it ends the match, sends the error to errs and skips the
+// games left.
+func (m *match) worker(ctx context.Context, games <-chan matchGame, errs chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
+	engines := make([]*UCIEngine, len(m.engines))
+	names := make([]string, len(m.engines))
+	for i, spec := range m.engines {
+		eng, err := NewUCIEngine(spec.path, spec.options)
+		if err != nil {
+			m.mu.Lock()
+			m.done = true
+			m.mu.Unlock()
+			errs <- fmt.Errorf("failed to start %s: %v", spec.path, err)
+			for range games {
+			}
+			return
+		}
+		defer eng.Close()
+		engines[i] = eng
+		names[i] = spec.name
+		if names[i] == "" {
+			names[i] = eng.Info.Name
+		}
+	}
+
+	for g := range games {
+		m.mu.Lock()
+		done := m.done
+		m.mu.Unlock()
+		if done {
+			continue
+		}
+		game, reason := m.play(ctx, g, engines, names)
+		m.record(g, game, reason, names)
+	}
+}
+
+func (m *match) record(g matchGame, game *pgnGame, reason string, names []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names = names
+	pair, firstWhite := [2]int{g.white, g.black}, true
+	if g.white > g.black {
+		pair, firstWhite = [2]int{g.black, g.white}, false
+	}
+	r := m.results[pair]
+	if r == nil {
+		r = new(pairResult)
+		m.results[pair] = r
+	}
+	r.add(game.Result, firstWhite)
+	log.Printf("Game %d: %s - %s %s {%s}", g.round, names[g.white], names[g.black], game.Result, reason)
+
+	if m.pgn != nil {
+		if err := game.Write(m.pgn); err != nil {
+			log.Fatal("Failed to write pgn: ", err)
+		}
+	}
+	if m.sprt.enabled && len(m.engines) == 2 {
+		if h, _ := m.sprtResult(r); h != "" {
+			m.done = true
+		}
+	}
+}
+
+// run plays every opening rounds times, with both colors, between each
+// pair of engines on concurrency workers. It returns the error of a worker
+// that failed, after the games already started are over.
+func (m *match) run(rounds, concurrency int) error {
+	games := make(chan matchGame)
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go m.worker(context.Background(), games, errs, &wg)
+	}
+	round := 0
+	for r := 0; r < rounds; r++ {
+		for _, opening := range m.openings {
+			for i := range m.engines {
+				for j := i + 1; j < len(m.engines); j++ {
+					var line []string
+					if m.book != nil {
+						start := chess.StartPosition()
+						if opening != "startpos" {
+							start, _ = chess.ParseFEN(opening)
+						}
+						line = m.book.Line(start, m.bookFlags.plies, m.bookFlags.random)
+					}
+					round++
+					games <- matchGame{round: round, white: i, black: j, opening: opening, book: line}
+					round++
+					games <- matchGame{round: round, white: j, black: i, opening: opening, book: line}
+				}
+			}
+		}
+	}
+	close(games)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (m *match) report() {
+	names := m.names
+	for i := range m.engines {
+		for j := i + 1; j < len(m.engines); j++ {
+			r := m.results[[2]int{i, j}]
+			if r == nil {
+				continue
+			}
+			elo, margin := r.Elo()
+			fmt.Printf("%s vs %s: +%d =%d -%d, Elo %.1f +/- %.1f\n", names[i], names[j], r.W, r.D, r.L, elo, margin)
+			if m.sprt.enabled {
+				h, llr := m.sprtResult(r)
+				lower, upper := math.Log(m.sprt.beta/(1-m.sprt.alpha)), math.Log((1-m.sprt.beta)/m.sprt.alpha)
+				verdict := "inconclusive"
+				switch h {
+				case "H1":
+					verdict = "passed"
+				case "H0":
+					verdict = "failed"
+				}
+				fmt.Printf("SPRT elo0=%g elo1=%g: LLR %.2f [%.2f, %.2f] %s\n", m.sprt.elo0, m.sprt.elo1, llr, lower, upper, verdict)
+			}
+		}
+	}
+}
+
+func readOpenings(path string) ([]string, error) {
+	if path == "" {
+		return []string{"startpos"}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var openings []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := chess.ParseFEN(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		openings = append(openings, line)
+	}
+	return openings, s.Err()
+}
+
+func matchCmd(args []string) {
+	fs := flag.NewFlagSet("match", flag.ExitOnError)
+	m := &match{results: make(map[[2]int]*pairResult)}
+	fs.Var(&m.engines, "e", "engine as path[,name=N][,Option=Value...], at least two")
+	book := fs.String("book", "", "file with one opening FEN per line, the start position if empty")
+	m.bookFlags.register(fs)
+	fs.BoolVar(&m.bookFlags.random, "book-random", true, "pick book moves at random by weight, else the heaviest")
+	rounds := fs.Int("rounds", 1, "times to play each opening with both colors")
+	concurrency := fs.Int("concurrency", 1, "games to play at the same time")
+	pgnPath := fs.String("pgn", "", "file to write the games to")
+	tc := fs.Duration("tc", 0, "base time per game, as in 1m30s")
+	inc := fs.Duration("inc", 0, "increment per move")
+	fs.DurationVar(&m.margin, "margin", 100*time.Millisecond, "time an engine may overstep its clock")
+	fs.IntVar(&m.limits.MovesToGo, "movestogo", 0, "moves of each control of -tc, which repeats, sudden death if 0")
+	fs.IntVar(&m.limits.MoveTime, "movetime", 0, "msec per move instead of a clock")
+	fs.IntVar(&m.limits.Depth, "depth", 0, "depth per move instead of a clock")
+	fs.IntVar(&m.limits.Nodes, "nodes", 0, "nodes per move instead of a clock")
+	fs.IntVar(&m.ResignScore, "resign-score", 1000, "centipawns to adjudicate a loss")
+	fs.IntVar(&m.ResignPlies, "resign-plies", 6, "plies both engines must agree on a loss, 0 to disable")
+	fs.IntVar(&m.DrawMove, "draw-move", 40, "first move to adjudicate draws")
+	fs.IntVar(&m.DrawScore, "draw-score", 10, "centipawns to adjudicate a draw")
+	fs.IntVar(&m.DrawPlies, "draw-plies", 8, "plies both engines must agree on a draw, 0 to disable")
+	fs.BoolVar(&m.sprt.enabled, "sprt", false, "run an SPRT and stop a match of two engines when it ends")
+	fs.Float64Var(&m.sprt.elo0, "elo0", 0, "SPRT null hypothesis, in BayesElo")
+	fs.Float64Var(&m.sprt.elo1, "elo1", 5, "SPRT alternative hypothesis, in BayesElo")
+	fs.Float64Var(&m.sprt.alpha, "alpha", 0.05, "SPRT false positive rate")
+	fs.Float64Var(&m.sprt.beta, "beta", 0.05, "SPRT false negative rate")
+	fs.Parse(args)
+
+	if len(m.engines) < 2 {
+		log.Fatal("A match needs at least two engines")
+	}
+	if *tc > 0 {
+		m.limits.WTime = int(*tc / time.Millisecond)
+		m.limits.BTime = m.limits.WTime
+		m.limits.WInc = int(*inc / time.Millisecond)
+		m.limits.BInc = m.limits.WInc
+	} else if !m.limits.bounded() {
+		log.Fatal("A match needs -tc, -movetime, -depth or -nodes")
+	} else if m.limits.MovesToGo > 0 {
+		log.Fatal("-movestogo needs -tc")
+	}
+	var err error
+	if m.openings, err = readOpenings(*book); err != nil {
+		log.Fatal(err)
+	}
+	if m.book, err = m.bookFlags.open(); err != nil {
+		log.Fatal(err)
+	}
+	if *pgnPath != "" {
+		if m.pgn, err = os.Create(*pgnPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = m.run(*rounds, *concurrency)
+	if m.pgn != nil {
+		if err := m.pgn.Close(); err != nil {
+			log.Fatal("Failed to write pgn: ", err)
+		}
+	}
+	m.report()
+	if err != nil {
+		log.Fatal("Match ended early: ", err)
+	}
+}
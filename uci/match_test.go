@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anastasop/oneshot/chess"
+)
+
+func TestLLR(t *testing.T) {
+	for _, c := range []struct {
+		r    pairResult
+		sign float64
+	}{
+		{pairResult{}, 0},
+		{pairResult{W: 20}, 1},
+		{pairResult{L: 20}, -1},
+		{pairResult{W: 30, D: 40}, 1},
+		{pairResult{D: 40, L: 30}, -1},
+		{pairResult{W: 300, D: 500, L: 200}, 1},
+		{pairResult{W: 200, D: 500, L: 300}, -1},
+	} {
+		llr := c.r.LLR(0, 5)
+		if math.IsNaN(llr) || math.IsInf(llr, 0) || llr*c.sign < 0 || (c.sign == 0) != (llr == 0) {
+			t.Errorf("LLR of %+v is %g", c.r, llr)
+		}
+	}
+}
+
+// TestMatchEngineFailure checks that an engine that does not start ends
+// the match with an error instead of the program.
+func TestMatchEngineFailure(t *testing.T) {
+	good := fakeHandshake + fakeReady + fakeSearch
+	m := &match{
+		engines:  engineSpecs{{path: good}, {path: "> uci\ncrash 3\n"}},
+		openings: []string{"startpos"},
+		limits:   SearchLimits{MoveTime: 10},
+		results:  make(map[[2]int]*pairResult),
+	}
+	err := m.run(2, 2)
+	if err == nil || !strings.Contains(err.Error(), "failed to start") {
+		t.Errorf("error is %v, want one that an engine failed to start", err)
+	}
+	if len(m.results) != 0 {
+		t.Errorf("results are %v, want none", m.results)
+	}
+}
+
+// TestGameClock plays 40/5m+1s, where every 40 moves of a side add
+// 5 minutes to its clock.
+func TestGameClock(t *testing.T) {
+	c := newGameClock(SearchLimits{WTime: 300000, BTime: 300000, WInc: 1000, BInc: 1000, MovesToGo: 40})
+	if tc := c.timeControl(); tc != "40/300+1" {
+		t.Errorf("time control is %s, want 40/300+1", tc)
+	}
+	for i := 0; i < 39; i++ {
+		if !c.punch(chess.White, 3*time.Second) {
+			t.Fatalf("white lost on time at move %d", i+1)
+		}
+	}
+	limits := c.limits(SearchLimits{}, chess.White)
+	if limits.WTime != 222000 || limits.BTime != 300000 || limits.MovesToGo != 1 {
+		t.Errorf("before the control limits are %+v", limits)
+	}
+	c.punch(chess.White, 3*time.Second)
+	limits = c.limits(SearchLimits{}, chess.White)
+	if limits.WTime != 520000 || limits.MovesToGo != 40 {
+		t.Errorf("after the control limits are %+v", limits)
+	}
+	if limits = c.limits(SearchLimits{}, chess.Black); limits.MovesToGo != 40 {
+		t.Errorf("black has %d moves to go, want 40", limits.MovesToGo)
+	}
+	if c.punch(chess.Black, 301*time.Second) {
+		t.Error("black did not lose on time")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/anastasop/oneshot/chess"
+)
+
+// pgnMove is a move of a game we write. NAG is a suffix like ?! and
+// Variations are alternatives to this move.
+type pgnMove struct {
+	SAN        string
+	NAG        string
+	Comment    string
+	Variations [][]pgnMove
+}
+
+type pgnGame struct {
+	Tags   map[string]string
+	Start  *chess.Position
+	Moves  []pgnMove
+	Result string
+}
+
+// pgnWriter wraps movetext at 80 columns.
+type pgnWriter struct {
+	w    *bufio.Writer
+	col  int
+	open bool // a '(' waits for the next token
+}
+
+func (pw *pgnWriter) token(t string) {
+	if pw.open {
+		t = "(" + t
+		pw.open = false
+	}
+	if pw.col > 0 && pw.col+1+len(t) > 79 {
+		pw.w.WriteByte('\n')
+		pw.col = 0
+	}
+	if pw.col > 0 {
+		pw.w.WriteByte(' ')
+		pw.col++
+	}
+	pw.w.WriteString(t)
+	pw.col += len(t)
+}
+
+func (pw *pgnWriter) moves(moves []pgnMove, start *chess.Position, ply int) {
+	number := true
+	for i, m := range moves {
+		turn := (int(start.Turn) + ply + i) % 2
+		n := start.FullMoves + (int(start.Turn)+ply+i)/2
+		if turn == 0 {
+			pw.token(fmt.Sprintf("%d.", n))
+		} else if number {
+			pw.token(fmt.Sprintf("%d...", n))
+		}
+		pw.token(m.SAN + m.NAG)
+		number = false
+		if m.Comment != "" {
+			pw.token("{ " + m.Comment + " }")
+			number = true
+		}
+		for _, v := range m.Variations {
+			pw.open = true
+			pw.moves(v, start, ply+i)
+			pw.w.WriteByte(')')
+			pw.col++
+			number = true
+		}
+	}
+}
+
+func (g *pgnGame) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	tags := make(map[string]string)
+	for k, v := range g.Tags {
+		tags[k] = v
+	}
+	tags["Result"] = g.Result
+	for _, k := range chess.SevenTagRoster {
+		v, ok := tags[k]
+		if !ok {
+			v = "?"
+		}
+		fmt.Fprintf(bw, "[%s \"%s\"]\n", k, pgnEscape(v))
+		delete(tags, k)
+	}
+	var others []string
+	for k := range tags {
+		others = append(others, k)
+	}
+	sort.Strings(others)
+	for _, k := range others {
+		fmt.Fprintf(bw, "[%s \"%s\"]\n", k, pgnEscape(tags[k]))
+	}
+	bw.WriteByte('\n')
+
+	pw := &pgnWriter{w: bw}
+	pw.moves(g.Moves, g.Start, 0)
+	pw.token(g.Result)
+	bw.WriteString("\n\n")
+	return bw.Flush()
+}
+
+func pgnEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// pgnEval is a score for a [%eval] comment, from white's point of view.
+func pgnEval(s Score, turn chess.Color) string {
+	v := s.Value
+	if turn == chess.Black {
+		v = -v
+	}
+	if s.Kind == ScoreMate {
+		return fmt.Sprintf("[%%eval #%d]", v)
+	}
+	return fmt.Sprintf("[%%eval %.2f]", float64(v)/100)
+}
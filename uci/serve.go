@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// apiRequest is the body of /evaluate and /analyze. /analyze also takes
+// it as query parameters, with moves separated by spaces or commas.
+type apiRequest struct {
+	FEN    string    `json:"fen"`
+	Moves  []string  `json:"moves"`
+	Limits apiLimits `json:"limits"`
+}
+
+type apiLimits struct {
+	Depth    int `json:"depth,omitempty"`
+	Nodes    int `json:"nodes,omitempty"`
+	MoveTime int `json:"movetime,omitempty"`
+	MultiPV  int `json:"multipv,omitempty"`
+}
+
+type apiScore struct {
+	CP    *int   `json:"cp,omitempty"`
+	Mate  *int   `json:"mate,omitempty"`
+	Bound string `json:"bound,omitempty"`
+	WDL   []int  `json:"wdl,omitempty"`
+}
+
+type apiLine struct {
+	Rank     int      `json:"rank"`
+	Score    apiScore `json:"score"`
+	PV       []string `json:"pv"`
+	SAN      []string `json:"san"`
+	Depth    int      `json:"depth"`
+	SelDepth int      `json:"seldepth,omitempty"`
+	Nodes    int      `json:"nodes,omitempty"`
+}
+
+// apiEvaluation is the answer to a request. Limits are those searched
+// with and Adjusted tells how the server changed the limits of the
+// request to get them.
+type apiEvaluation struct {
+	BestMove string    `json:"bestmove"`
+	Ponder   string    `json:"ponder,omitempty"`
+	Lines    []apiLine `json:"lines"`
+	Limits   apiLimits `json:"limits"`
+	Adjusted []string  `json:"adjusted,omitempty"`
+}
+
+func newAPIScore(s Score) apiScore {
+	var a apiScore
+	v := s.Value
+	switch s.Kind {
+	case ScoreCP:
+		a.CP = &v
+	case ScoreMate:
+		a.Mate = &v
+	}
+	switch s.Bound {
+	case BoundLower:
+		a.Bound = "lower"
+	case BoundUpper:
+		a.Bound = "upper"
+	}
+	if s.WDL != nil {
+		a.WDL = []int{s.WDL.Win, s.WDL.Draw, s.WDL.Loss}
+	}
+	return a
+}
+
+func newAPILine(v UCIVariation) apiLine {
+	return apiLine{
+		Rank:     v.Rank,
+		Score:    newAPIScore(v.Score),
+		PV:       v.Moves,
+		SAN:      v.SAN,
+		Depth:    v.Depth,
+		SelDepth: v.SelectiveDepth,
+		Nodes:    v.Nodes,
+	}
+}
+
+func newAPIEvaluation(eval UCIPositionEvaluation, limits SearchLimits, adjusted []string) apiEvaluation {
+	a := apiEvaluation{
+		BestMove: eval.BestMove,
+		Ponder:   eval.PonderMove,
+		Lines:    []apiLine{},
+		Limits:   apiLimits{Depth: limits.Depth, Nodes: limits.Nodes, MoveTime: limits.MoveTime, MultiPV: limits.MultiPV},
+		Adjusted: adjusted,
+	}
+	for _, v := range eval.Variations {
+		a.Lines = append(a.Lines, newAPILine(v))
+	}
+	return a
+}
+
+// server puts an engine pool behind HTTP. Requests wait in a queue of at
+// most maxQueue for a free engine and each client, by X-Client-Id header
+// or else by address, may have clientJobs of them at a time.
+type server struct {
+	pool       *EnginePool
+	maxQueue   int
+	clientJobs int
+	defaults   SearchLimits // used when a request has no limits
+	max        SearchLimits // caps on the limits of a request
+
+	mu        sync.Mutex
+	inflight  int
+	clients   map[string]int
+	served    int
+	failed    int
+	lastErr   string
+	lastErrAt time.Time
+	started   time.Time
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func clientID(r *http.Request) string {
+	if id := r.Header.Get("X-Client-Id"); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admit counts a request in, or refuses it if the client or the queue
+// is full. The returned func counts it out.
+func (s *server) admit(r *http.Request) (func(), error) {
+	id := clientID(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[id] >= s.clientJobs {
+		return nil, &httpError{http.StatusTooManyRequests, fmt.Sprintf("client %s has %d requests running", id, s.clients[id])}
+	}
+	if s.inflight >= s.pool.Size()+s.maxQueue {
+		return nil, &httpError{http.StatusServiceUnavailable, "queue is full"}
+	}
+	s.clients[id]++
+	s.inflight++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.clients[id]--; s.clients[id] == 0 {
+			delete(s.clients, id)
+		}
+		s.inflight--
+	}, nil
+}
+
+func (s *server) done(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.served++
+	var uerr *UCIError
+	if errors.As(err, &uerr) {
+		s.failed++
+		s.lastErr = err.Error()
+		s.lastErrAt = time.Now()
+	}
+}
+
+// position checks the request and applies the server's limits. It
+// returns how it changed the limits of the request, to tell the client.
+func (s *server) position(req *apiRequest) (UCIPosition, SearchLimits, []string, error) {
+	pos := UCIPosition{FEN: req.FEN, Moves: req.Moves}
+	if pos.FEN == "" {
+		pos.FEN = "startpos"
+	}
+	p, err := pos.Validate()
+	if err != nil {
+		return pos, SearchLimits{}, nil, &httpError{http.StatusBadRequest, err.Error()}
+	}
+	if len(p.LegalMoves()) == 0 {
+		return pos, SearchLimits{}, nil, &httpError{http.StatusBadRequest, "the game is over"}
+	}
+
+	limits := SearchLimits{
+		Depth:    req.Limits.Depth,
+		Nodes:    req.Limits.Nodes,
+		MoveTime: req.Limits.MoveTime,
+		MultiPV:  req.Limits.MultiPV,
+	}
+	var adjusted []string
+	if !limits.bounded() {
+		limits.Depth, limits.Nodes, limits.MoveTime = s.defaults.Depth, s.defaults.Nodes, s.defaults.MoveTime
+		adjusted = append(adjusted, "no depth, nodes or movetime given, the server defaults are used")
+	}
+	capAt := func(name string, v *int, max int) {
+		if max > 0 && *v > max {
+			adjusted = append(adjusted, fmt.Sprintf("%s %d is capped at %d", name, *v, max))
+			*v = max
+		}
+	}
+	capAt("depth", &limits.Depth, s.max.Depth)
+	capAt("nodes", &limits.Nodes, s.max.Nodes)
+	capAt("movetime", &limits.MoveTime, s.max.MoveTime)
+	capAt("multipv", &limits.MultiPV, s.max.MultiPV)
+	// a search by depth or nodes may take any time, so it gets the
+	// longest one as well
+	if s.max.MoveTime > 0 && limits.MoveTime == 0 {
+		limits.MoveTime = s.max.MoveTime
+		adjusted = append(adjusted, fmt.Sprintf("movetime %d is added, the longest search of the server", s.max.MoveTime))
+	}
+	return pos, limits, adjusted, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var herr *httpError
+	if errors.As(err, &herr) {
+		code = herr.code
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (s *server) handleEvaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, &httpError{http.StatusMethodNotAllowed, "use POST"})
+		return
+	}
+	var req apiRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, &httpError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	pos, limits, adjusted, err := s.position(&req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	release, err := s.admit(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	eval, err := s.pool.Evaluate(r.Context(), pos, limits)
+	s.done(err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIEvaluation(eval, limits, adjusted))
+}
+
+// maxRequestBody is the largest request body we read, far more than the
+// moves of any game take.
+const maxRequestBody = 64 << 10
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, req *apiRequest) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(req)
+}
+
+func analyzeRequest(w http.ResponseWriter, r *http.Request) (*apiRequest, error) {
+	var req apiRequest
+	if r.Method == http.MethodPost {
+		if err := decodeRequest(w, r, &req); err != nil {
+			return nil, err
+		}
+		return &req, nil
+	}
+	q := r.URL.Query()
+	req.FEN = q.Get("fen")
+	req.Moves = strings.FieldsFunc(q.Get("moves"), func(c rune) bool { return c == ' ' || c == ',' })
+	for name, v := range map[string]*int{
+		"depth":    &req.Limits.Depth,
+		"nodes":    &req.Limits.Nodes,
+		"movetime": &req.Limits.MoveTime,
+		"multipv":  &req.Limits.MultiPV,
+	} {
+		if q.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil {
+			return nil, fmt.Errorf("bad %s '%s'", name, q.Get(name))
+		}
+		*v = n
+	}
+	return &req, nil
+}
+
+// handleAnalyze streams the engine's info lines as Server-Sent Events
+// and ends with a result, or error, event. Closing the connection stops
+// the search. A position the tablebase or the cache answers gets only
+// the result event.
+func (s *server) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	req, err := analyzeRequest(w, r)
+	if err != nil {
+		writeError(w, &httpError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	pos, limits, adjusted, err := s.position(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming is not supported"))
+		return
+	}
+	release, err := s.admit(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	event := func(name string, v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+		flusher.Flush()
+	}
+
+	ctx := r.Context()
+	if eval, ok := s.pool.Lookup(ctx, pos, limits); ok {
+		s.done(nil)
+		event("result", newAPIEvaluation(eval, limits, adjusted))
+		return
+	}
+	eng, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer s.pool.Release(eng)
+
+	a, err := eng.StartAnalysis(ctx, pos, limits)
+	if err != nil {
+		s.done(err)
+		event("error", map[string]string{"error": err.Error()})
+		return
+	}
+	variations := make(map[int]UCIVariation)
+	for info := range a.Info {
+		if info.PV == nil {
+			continue
+		}
+		v := UCIVariation{
+			Rank:           info.MultiPV,
+			Score:          info.Score,
+			Moves:          info.PV,
+			SAN:            sanLine(a.start, info.PV),
+			Depth:          info.Depth,
+			SelectiveDepth: info.SelectiveDepth,
+			Nodes:          info.Nodes,
+		}
+		variations[v.Rank] = v
+		event("info", newAPILine(v))
+	}
+	eval, err := a.Wait()
+	s.done(err)
+	if err != nil {
+		event("error", map[string]string{"error": err.Error()})
+		return
+	}
+	for rank := 1; rank <= len(variations); rank++ {
+		if v, ok := variations[rank]; ok {
+			eval.Variations = append(eval.Variations, v)
+		}
+	}
+	s.pool.Store(ctx, pos, limits, eval)
+	event("result", newAPIEvaluation(eval, limits, adjusted))
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idle := s.pool.Idle()
+	health := map[string]interface{}{
+		"engine":  s.pool.name,
+		"engines": s.pool.Size(),
+		"busy":    s.pool.Size() - idle,
+		"queued":  s.inflight - (s.pool.Size() - idle),
+		"clients": len(s.clients),
+		"served":  s.served,
+		"failed":  s.failed,
+		"uptime":  time.Since(s.started).Round(time.Second).String(),
+	}
+	if s.lastErr != "" {
+		health["last_error"] = s.lastErr
+		health["last_error_at"] = s.lastErrAt.Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+func serveCmd(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var ef engineFlags
+	ef.register(fs, 1000)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	s := &server{clients: make(map[string]int), started: time.Now()}
+	fs.IntVar(&s.maxQueue, "queue", 64, "requests that may wait for an engine")
+	fs.IntVar(&s.clientJobs, "client-jobs", 2, "requests a client may have at a time")
+	fs.IntVar(&s.max.MoveTime, "max-movetime", 10000, "longest search in msec, 0 for no limit")
+	fs.IntVar(&s.max.Depth, "max-depth", 0, "deepest search, 0 for no limit")
+	fs.IntVar(&s.max.Nodes, "max-nodes", 0, "largest search in nodes, 0 for no limit")
+	fs.IntVar(&s.max.MultiPV, "max-multipv", 5, "most lines per search")
+	fs.Parse(args)
+
+	s.defaults = ef.searchLimits(fs)
+	pool, err := ef.pool()
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	s.pool = pool
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/evaluate", s.handleEvaluate)
+	mux.HandleFunc("/analyze", s.handleAnalyze)
+	mux.HandleFunc("/health", s.handleHealth)
+	// cancelling the base context stops the searches of the requests, so
+	// Shutdown does not wait for them to run out
+	base, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:        *addr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Println("Shutting down on", <-sig)
+		cancel()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Println("Failed to shut down: ", err)
+		}
+	}()
+
+	log.Println("Serving", pool.name, "x", pool.Size(), "on", *addr)
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-stopped
+		err = nil
+	}
+	if cerr := pool.Close(); cerr != nil {
+		log.Println("Failed to close the engines: ", cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
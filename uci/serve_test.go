@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerPosition(t *testing.T) {
+	s := &server{
+		defaults: SearchLimits{Depth: 10},
+		max:      SearchLimits{Depth: 20, MoveTime: 1000, MultiPV: 3},
+	}
+	for _, c := range []struct {
+		limits   apiLimits
+		want     SearchLimits
+		adjusted int
+	}{
+		{apiLimits{MoveTime: 500}, SearchLimits{MoveTime: 500}, 0},
+		{apiLimits{MoveTime: 5000, MultiPV: 2}, SearchLimits{MoveTime: 1000, MultiPV: 2}, 1},
+		{apiLimits{Depth: 30, MultiPV: 5}, SearchLimits{Depth: 20, MoveTime: 1000, MultiPV: 3}, 3},
+		{apiLimits{}, SearchLimits{Depth: 10, MoveTime: 1000}, 2},
+	} {
+		_, limits, adjusted, err := s.position(&apiRequest{Limits: c.limits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(limits, c.want) || len(adjusted) != c.adjusted {
+			t.Errorf("%+v gives %+v %q, want %+v and %d changes", c.limits, limits, adjusted, c.want, c.adjusted)
+		}
+	}
+	if _, _, _, err := s.position(&apiRequest{Moves: []string{"e2e5"}}); err == nil {
+		t.Error("an illegal move is accepted")
+	}
+}
+
+// TestAnalyzeCache checks that /analyze answers from the cache, since the
+// engine never answers a go.
+func TestAnalyzeCache(t *testing.T) {
+	pool, err := NewEnginePool(fakeHandshake+fakeReady, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if pool.Cache, err = OpenEvalCache(filepath.Join(t.TempDir(), "evals.cache"), 10); err != nil {
+		t.Fatal(err)
+	}
+	pos, limits := UCIPosition{FEN: "startpos"}, SearchLimits{Depth: 12}
+	pool.Store(context.Background(), pos, limits, UCIPositionEvaluation{
+		BestMove:   "e2e4",
+		Variations: []UCIVariation{{Rank: 1, Depth: 12, Moves: []string{"e2e4", "e7e5"}}},
+	})
+
+	s := &server{pool: pool, clients: make(map[string]int), clientJobs: 1}
+	w := httptest.NewRecorder()
+	s.handleAnalyze(w, httptest.NewRequest("GET", "/analyze?depth=12", nil))
+	body := w.Body.String()
+	const prefix = "event: result\ndata: "
+	if !strings.HasPrefix(body, prefix) {
+		t.Fatalf("answer is %q, want a result event", body)
+	}
+	var result apiEvaluation
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body[len(prefix):])), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.BestMove != "e2e4" || len(result.Lines) != 1 || !reflect.DeepEqual(result.Lines[0].SAN, []string{"e4", "e5"}) {
+		t.Errorf("result is %+v", result)
+	}
+}
+
+// TestEvaluateCacheBounded checks that a search by depth is cached even
+// when the server bounds it by its longest movetime.
+func TestEvaluateCacheBounded(t *testing.T) {
+	pool, err := NewEnginePool(fakeHandshake+fakeReady+fakeSearch, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if pool.Cache, err = OpenEvalCache(filepath.Join(t.TempDir(), "evals.cache"), 10); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{pool: pool, clients: make(map[string]int), clientJobs: 1, maxQueue: 1, max: SearchLimits{MoveTime: 10000}}
+	pos := UCIPosition{FEN: "startpos"}
+	limits := SearchLimits{Depth: 2, MoveTime: 10000}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		s.handleEvaluate(w, httptest.NewRequest("POST", "/evaluate", strings.NewReader(`{"limits": {"depth": 2}}`)))
+		var result apiEvaluation
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("request %d: %v: %s", i+1, err, w.Body.String())
+		}
+		if w.Code != 200 || result.BestMove != "e2e4" || result.Limits.MoveTime != 10000 {
+			t.Errorf("request %d: answer is %d %s", i+1, w.Code, w.Body.String())
+		}
+		if _, ok := pool.Lookup(context.Background(), pos, limits); !ok {
+			t.Fatalf("request %d: the search is not cached", i+1)
+		}
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	s := &server{clients: make(map[string]int), clientJobs: 1}
+	body := `{"fen": "startpos", "moves": [` + strings.Repeat(`"e2e4", `, maxRequestBody/8) + `"e2e4"]}`
+	w := httptest.NewRecorder()
+	s.handleEvaluate(w, httptest.NewRequest("POST", "/evaluate", strings.NewReader(body)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "too large") {
+		t.Errorf("answer to a large body is %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+// GameSession plays one game with an engine. It keeps the moves of the
+// game and sends them with every search, so the engine sees a single
+// game started by one 'ucinewgame'.
+//
+// With pondering on, after each of its moves the engine searches the
+// reply it expects from the opponent, with the limits of that move. When
+// the opponent plays that reply and the next Go has the same limits, it
+// turns the ponder search into the real one with 'ponderhit'; otherwise
+// the ponder search is stopped and a new one starts.
+type GameSession struct {
+	eng     *UCIEngine
+	fen     string
+	moves   []string
+	started bool
+
+	ponder    bool
+	pondering *ponderSearch
+
+	// Book, if set, gives the engine's moves, weighted at random, until
+	// the game leaves it.
+	Book    *Book
+	outBook bool
+}
+
+type ponderSearch struct {
+	ply    int          // the ply of the move pondered on
+	move   string       // the move pondered on
+	limits SearchLimits // the limits pondered with, without Ponder
+	a      *UCIAnalysis
+	cancel context.CancelFunc
+	result chan ponderResult
+}
+
+type ponderResult struct {
+	eval UCIPositionEvaluation
+	err  error
+}
+
+// NewGameSession starts a game from fen, or the start position if fen
+// is empty. The engine must not be used for anything else until the
+// session is closed.
+func NewGameSession(eng *UCIEngine, fen string, ponder bool) (*GameSession, error) {
+	if fen == "" {
+		fen = "startpos"
+	}
+	if ponder {
+		if _, ok := eng.Info.Options["ponder"]; ok {
+			if err := eng.SetOption("Ponder", "true"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &GameSession{eng: eng, fen: fen, ponder: ponder}, nil
+}
+
+// Moves returns the moves played so far.
+func (s *GameSession) Moves() []string {
+	return append([]string(nil), s.moves...)
+}
+
+// Play records the opponent's move. A move that is not legal in the
+// current position is not recorded and fails with a *PositionError.
+func (s *GameSession) Play(move string) error {
+	moves := append(s.Moves(), move)
+	if _, err := (UCIPosition{FEN: s.fen, Moves: moves}).Validate(); err != nil {
+		return err
+	}
+	s.moves = moves
+	return nil
+}
+
+func (s *GameSession) position() UCIPosition {
+	pos := UCIPosition{NewGame: !s.started, FEN: s.fen, Moves: append([]string{}, s.moves...)}
+	s.started = true
+	return pos
+}
+
+// Go searches the current position with limits, plays the engine's move
+// and returns it with the evaluation. A cancelled ctx ends the search
+// with the best move found so far. A ponder search goes on after a
+// ponderhit with the limits it was started with, as 'ponderhit' has no
+// arguments, so it is used only if they are the same as limits.
+func (s *GameSession) Go(ctx context.Context, limits SearchLimits) (UCIPositionEvaluation, error) {
+	if !limits.bounded() {
+		return UCIPositionEvaluation{}, errors.New("GameSession needs limits that end the search")
+	}
+	if s.Book != nil && !s.outBook {
+		p, err := UCIPosition{FEN: s.fen, Moves: s.moves}.Validate()
+		if err != nil {
+			return UCIPositionEvaluation{}, err
+		}
+		if m, ok := s.Book.Pick(p, true); ok {
+			s.moves = append(s.moves, m.String())
+			return UCIPositionEvaluation{BestMove: m.String()}, nil
+		}
+		s.outBook = true
+	}
+	var eval UCIPositionEvaluation
+	var err error
+	if p := s.pondering; p != nil && len(s.moves) == p.ply+1 && s.moves[p.ply] == p.move && reflect.DeepEqual(p.limits, limits) {
+		s.pondering = nil
+		if err := p.a.PonderHit(); err != nil {
+			p.cancel()
+			<-p.result
+			return UCIPositionEvaluation{}, err
+		}
+		var r ponderResult
+		select {
+		case r = <-p.result:
+		case <-ctx.Done():
+			p.cancel()
+			r = <-p.result
+		}
+		p.cancel()
+		eval, err = r.eval, r.err
+	} else {
+		s.stopPondering()
+		var a *UCIAnalysis
+		if a, err = s.eng.StartAnalysis(ctx, s.position(), limits); err == nil {
+			eval, err = a.Result()
+		}
+	}
+	if err != nil {
+		return eval, err
+	}
+
+	if eval.BestMove == "" || eval.BestMove == "(none)" {
+		return eval, nil
+	}
+	s.moves = append(s.moves, eval.BestMove)
+	if s.ponder && eval.PonderMove != "" {
+		s.startPondering(eval.PonderMove, limits)
+	}
+	return eval, nil
+}
+
+func (s *GameSession) startPondering(move string, limits SearchLimits) {
+	ply := len(s.moves)
+	s.moves = append(s.moves, move)
+	pos := s.position()
+	s.moves = s.moves[:ply]
+
+	p := &ponderSearch{ply: ply, move: move, limits: limits, result: make(chan ponderResult, 1)}
+	limits.Ponder = true
+	ctx, cancel := context.WithCancel(context.Background())
+	a, err := s.eng.StartAnalysis(ctx, pos, limits)
+	if err != nil {
+		// the engine was restarted, if needed, and the next Go searches
+		// as if we never pondered
+		cancel()
+		return
+	}
+	p.a, p.cancel = a, cancel
+	go func() {
+		eval, err := a.Result()
+		p.result <- ponderResult{eval, err}
+	}()
+	s.pondering = p
+}
+
+// stopPondering ends a ponder search that missed and forgets its result.
+func (s *GameSession) stopPondering() {
+	if p := s.pondering; p != nil {
+		s.pondering = nil
+		p.cancel()
+		<-p.result
+	}
+}
+
+// Close stops pondering. It does not close the engine.
+func (s *GameSession) Close() {
+	s.stopPondering()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anastasop/oneshot/chess"
+)
+
+// Tablebase answers positions with few pieces from a directory of Syzygy
+// tables. The tables are probed by fathom, the command line prober built
+// from apps/fathom.c of https://github.com/jdart1/Fathom, as the engines
+// are run by their executables. Probe reads the WDL and DTZ tags and the
+// moves of the PGN it prints.
+//
+// Syzygy tables know who wins and how many moves to the next zeroing of
+// the fifty move counter (DTZ), not the distance to mate. A win is given
+// as a centipawn score of 20000 - DTZ, as Stockfish does, and the WDL of
+// the score is the certain result.
+type Tablebase struct {
+	dir       string
+	fathom    string
+	tables    map[string]bool // the material of each table, as in KRPvKR
+	MaxPieces int
+}
+
+// OpenTablebase finds the WDL tables in dir. The DTZ tables are expected
+// next to them.
+func OpenTablebase(dir, fathom string) (*Tablebase, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.rtbw"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no syzygy tables in %s", dir)
+	}
+	if fathom, err = exec.LookPath(fathom); err != nil {
+		return nil, err
+	}
+	tb := &Tablebase{dir: dir, fathom: fathom, tables: make(map[string]bool)}
+	for _, f := range files {
+		material := strings.TrimSuffix(filepath.Base(f), ".rtbw")
+		tb.tables[material] = true
+		if n := len(material) - 1; n > tb.MaxPieces {
+			tb.MaxPieces = n
+		}
+	}
+	return tb, nil
+}
+
+// material is the material of p, as in KRvKP, with White's pieces first
+// and then with Black's first. Tables are named stronger side first, so
+// either may be the name of the table of p.
+func material(p *chess.Position) (string, string) {
+	var sides [2]string
+	for _, kind := range "kqrbnp" {
+		for _, piece := range p.Board {
+			if piece != chess.NoPiece && piece.Kind() == chess.Piece(kind) {
+				sides[piece.Color()] += strings.ToUpper(string(kind))
+			}
+		}
+	}
+	return sides[chess.White] + "v" + sides[chess.Black], sides[chess.Black] + "v" + sides[chess.White]
+}
+
+// Covers reports whether p is in the tables. Positions with castling
+// rights are not and neither are those where the game is over.
+func (tb *Tablebase) Covers(p *chess.Position) bool {
+	if p.Castling != 0 || len(p.LegalMoves()) == 0 {
+		return false
+	}
+	m1, m2 := material(p)
+	if len(m1)-1 > tb.MaxPieces {
+		return false
+	}
+	return tb.tables[m1] || tb.tables[m2]
+}
+
+var tablebaseWDL = map[string]WDL{
+	"Win":         {Win: 1000},
+	"CursedWin":   {Draw: 1000},
+	"Draw":        {Draw: 1000},
+	"BlessedLoss": {Draw: 1000},
+	"Loss":        {Loss: 1000},
+}
+
+// Probe evaluates p, which must be covered, with the line that keeps
+// the result with the fewest moves to each zeroing.
+func (tb *Tablebase) Probe(ctx context.Context, p *chess.Position) (UCIPositionEvaluation, error) {
+	cmd := exec.CommandContext(ctx, tb.fathom, "--path="+tb.dir, p.FEN())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return UCIPositionEvaluation{}, fmt.Errorf("fathom: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// the output is a PGN game with the result in tags
+	tags := make(map[string]string)
+	var movetext []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if i := strings.Index(line, " "); i > 0 {
+				tags[line[1:i]] = strings.Trim(line[i+1:len(line)-1], `"`)
+			}
+			continue
+		}
+		movetext = append(movetext, strings.Fields(line)...)
+	}
+
+	wdl, ok := tablebaseWDL[tags["WDL"]]
+	if !ok {
+		return UCIPositionEvaluation{}, fmt.Errorf("fathom: no result for %s", p.FEN())
+	}
+	dtz, _ := strconv.Atoi(tags["DTZ"])
+	score := Score{Kind: ScoreCP, WDL: &wdl}
+	switch tags["WDL"] {
+	case "Win":
+		score.Value = 20000 - dtz
+	case "Loss":
+		score.Value = -20000 + dtz
+	}
+
+	v := UCIVariation{Rank: 1, Score: score}
+	q := p
+	for _, token := range movetext {
+		switch token = strings.TrimLeft(token, "0123456789."); token {
+		case "", "-1", "-0", "/2-1/2", "*":
+			continue // move numbers and results
+		}
+		m, err := q.ParseSAN(token)
+		if err != nil {
+			break
+		}
+		v.Moves = append(v.Moves, m.String())
+		v.SAN = append(v.SAN, q.SAN(m))
+		q = q.Play(m)
+	}
+	v.Depth = len(v.Moves)
+
+	eval := UCIPositionEvaluation{Variations: []UCIVariation{v}}
+	if len(v.Moves) > 0 {
+		eval.BestMove = v.Moves[0]
+	}
+	if len(v.Moves) > 1 {
+		eval.PonderMove = v.Moves[1]
+	}
+	return eval, nil
+}
+
+// tablebaseAnswers reports whether the tablebase can stand in for a
+// search with limits: it knows one line and has no notion of searching
+// some moves only.
+func tablebaseAnswers(limits SearchLimits) bool {
+	return limits.MultiPV <= 1 && len(limits.SearchMoves) == 0 && !limits.Infinite && !limits.Ponder
+}
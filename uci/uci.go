@@ -0,0 +1,1240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anastasop/oneshot/chess"
+)
+
+type UCIEngine struct {
+	cmd     *exec.Cmd
+	w       io.Writer
+	lines   chan string
+	readErr error
+	stderr  *tailBuffer
+
+	path    string
+	options map[string]string
+	unready int // readyok lines owed for isready waits that were cancelled
+
+	Info EngineInfo
+
+	// Timeout is how long we wait for an answer the engine owes us:
+	// uciok, readyok or the bestmove after a stop. A search by time may
+	// overrun its movetime, or the clock and increment of the side to
+	// move, by Timeout and one by depth, nodes or mate may go Timeout
+	// without an info line. An engine that is late is considered hung,
+	// killed and restarted.
+	Timeout time.Duration
+}
+
+var ErrEngineTimeout = errors.New("engine did not answer in time")
+
+// UCIError is a failure of the engine process itself, as opposed to a
+// bad request. Phase is the protocol step that failed and Stderr is the
+// last output the engine wrote there.
+type UCIError struct {
+	Phase  string
+	Err    error
+	Stderr string
+}
+
+func (e *UCIError) Error() string {
+	msg := fmt.Sprintf("engine failed at %s: %v", e.Phase, e.Err)
+	if e.Stderr != "" {
+		msg += fmt.Sprintf(" (stderr: %q)", e.Stderr)
+	}
+	return msg
+}
+
+func (e *UCIError) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer keeps the last bytes written to it.
+type tailBuffer struct {
+	sync.Mutex
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.Lock()
+	defer t.Unlock()
+	return strings.TrimSpace(string(t.buf))
+}
+
+type UCIOptionType string
+
+const (
+	OptionCheck  UCIOptionType = "check"
+	OptionSpin   UCIOptionType = "spin"
+	OptionCombo  UCIOptionType = "combo"
+	OptionButton UCIOptionType = "button"
+	OptionString UCIOptionType = "string"
+)
+
+// UCIOption is an option the engine declared after 'uci'. Min and Max
+// are used only by spin options and Vars only by combo options.
+type UCIOption struct {
+	Name     string
+	Type     UCIOptionType
+	Default  string
+	Min, Max int
+	Vars     []string
+}
+
+// EngineInfo is what the engine tells about itself. Options are keyed by
+// lowercase name since UCI option names are case insensitive.
+type EngineInfo struct {
+	Name    string
+	Author  string
+	Options map[string]UCIOption
+}
+
+type tUCIInfo struct {
+	MultiPV int
+	PV      []string
+	Score   Score
+
+	Nodes          int
+	Depth          int
+	SelectiveDepth int
+	Time           int
+
+	CurrMove       string
+	CurrMoveNumber int
+	CurrLine       []string
+	Refutation     []string
+
+	Hashfull              float32
+	NodesPerSec           int
+	TableBaseHits         int
+	TableBaseHitsShredder int
+	Cpuload               float32
+	Informational         string
+}
+
+type ScoreKind int
+
+const (
+	ScoreNone ScoreKind = iota
+	ScoreCP
+	ScoreMate
+)
+
+type ScoreBound int
+
+const (
+	BoundExact ScoreBound = iota
+	BoundLower
+	BoundUpper
+)
+
+// WDL are the win, draw and loss chances in permille.
+type WDL struct {
+	Win, Draw, Loss int
+}
+
+// Score is an engine score from the side to move's point of view. Value
+// is centipawns for ScoreCP and moves to mate for ScoreMate, negative if
+// the side to move gets mated. Mate in 0 means the side to move is mated.
+type Score struct {
+	Kind  ScoreKind
+	Value int
+	Bound ScoreBound
+	WDL   *WDL
+}
+
+const mateKey = 1000000
+
+// key maps scores to ints in their order of preference: faster mates
+// first, then centipawns, then slower and faster mates against.
+func (s Score) key() int {
+	if s.Kind == ScoreMate {
+		if s.Value > 0 {
+			return mateKey - s.Value
+		}
+		return -mateKey - s.Value
+	}
+	return s.Value
+}
+
+// Compare returns -1, 0 or +1 if s is worse, as good as or better than t
+// for the side to move.
+func (s Score) Compare(t Score) int {
+	a, b := s.key(), t.key()
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
+// WinProbability is the expected score of the side to move, from the
+// engine's WDL if there is one or else from the centipawns with the
+// model lichess uses for its accuracy.
+func (s Score) WinProbability() float64 {
+	switch {
+	case s.WDL != nil:
+		return (float64(s.WDL.Win) + float64(s.WDL.Draw)/2) / 1000
+	case s.Kind == ScoreMate && s.Value > 0:
+		return 1
+	case s.Kind == ScoreMate:
+		return 0
+	}
+	return 1 / (1 + math.Exp(-0.00368208*float64(s.Value)))
+}
+
+func (s Score) String() string {
+	var str string
+	switch s.Kind {
+	case ScoreNone:
+		return "?"
+	case ScoreCP:
+		str = fmt.Sprintf("%+.2f", float64(s.Value)/100)
+	case ScoreMate:
+		str = fmt.Sprintf("#%d", s.Value)
+	}
+	switch s.Bound {
+	case BoundLower:
+		str += "+"
+	case BoundUpper:
+		str += "-"
+	}
+	return str
+}
+
+// UCIVariation is one line of a MultiPV search.
+type UCIVariation struct {
+	Rank  int
+	Score Score
+	Moves []string
+	SAN   []string // Moves in SAN, up to the first one that is not legal
+
+	Depth          int
+	SelectiveDepth int
+	Nodes          int
+}
+
+type UCIPositionEvaluation struct {
+	BestMove   string
+	PonderMove string
+	Variations []UCIVariation
+}
+
+type UCIPosition struct {
+	NewGame bool
+	FEN     string
+	Moves   []string
+}
+
+// PositionError is a position we refuse to send to the engine because
+// its FEN is bad or one of its moves is not legal. Ply is the number of
+// the bad move, counting from 1, or 0 if the FEN is bad.
+type PositionError struct {
+	FEN  string
+	Ply  int
+	Move string
+	Err  error
+}
+
+func (e *PositionError) Error() string {
+	if e.Ply == 0 {
+		return fmt.Sprintf("bad position: %v", e.Err)
+	}
+	return fmt.Sprintf("bad position: ply %d '%s': %v", e.Ply, e.Move, e.Err)
+}
+
+func (e *PositionError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks the FEN and plays the moves on it. It returns the
+// position reached. It uses the chess package because gochess.Board can
+// only replay SAN from the start position.
+func (pos UCIPosition) Validate() (*chess.Position, error) {
+	p := chess.StartPosition()
+	if pos.FEN != "startpos" {
+		var err error
+		if p, err = chess.ParseFEN(pos.FEN); err != nil {
+			return nil, &PositionError{FEN: pos.FEN, Err: err}
+		}
+	}
+	for i, uci := range pos.Moves {
+		m, err := p.ParseUCI(uci)
+		if err != nil {
+			return nil, &PositionError{FEN: pos.FEN, Ply: i + 1, Move: uci, Err: err}
+		}
+		p = p.Play(m)
+	}
+	return p, nil
+}
+
+// sanLine converts the moves of a variation from p to SAN and stops at
+// the first one that is not legal.
+func sanLine(p *chess.Position, moves []string) []string {
+	san := []string{}
+	for _, uci := range moves {
+		m, err := p.ParseUCI(uci)
+		if err != nil {
+			break
+		}
+		san = append(san, p.SAN(m))
+		p = p.Play(m)
+	}
+	return san
+}
+
+// SearchLimits are the arguments of the 'go' command. Times are in
+// milliseconds and zero values are not sent, but for the clocks: WTime
+// and BTime are sent together if either is set, so a clock that ran
+// down to zero is sent as 0.
+type SearchLimits struct {
+	SearchMoves  []string
+	Ponder       bool
+	WTime, BTime int
+	WInc, BInc   int
+	MovesToGo    int
+	Depth        int
+	Nodes        int
+	Mate         int
+	MoveTime     int
+	Infinite     bool
+
+	// MultiPV is not part of 'go' but sets the engine option of the
+	// same name before searching. Zero is the same as one.
+	MultiPV int
+}
+
+// UCIAnalysis is a search running in the engine. Info delivers every
+// info line the engine sends and is closed when the search ends; it
+// must be drained before Wait returns.
+type UCIAnalysis struct {
+	Info <-chan tUCIInfo
+
+	start     *chess.Position
+	ponderhit chan struct{}
+	done      chan struct{}
+	eval      UCIPositionEvaluation
+	err       error
+}
+
+func (a *UCIAnalysis) Wait() (UCIPositionEvaluation, error) {
+	<-a.done
+	return a.eval, a.err
+}
+
+// PonderHit tells an engine that ponders that the opponent played the
+// move it expected. The search goes on as a normal one with the limits
+// it was started with. It fails if the search was not started with
+// Ponder.
+func (a *UCIAnalysis) PonderHit() error {
+	if a.ponderhit == nil {
+		return errors.New("ponderhit on a search that does not ponder")
+	}
+	select {
+	case a.ponderhit <- struct{}{}:
+	case <-a.done:
+	}
+	return nil
+}
+
+func parseInfoLine(line string) tUCIInfo {
+	tokens := append(strings.Fields(line), "", "", "", "", "")
+	var info tUCIInfo
+	var wdl *WDL
+	info.MultiPV = 1
+	for i := 1; i < len(tokens); {
+		switch tokens[i] {
+		case "depth":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.Depth = v
+				i++
+			}
+		case "seldepth":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.SelectiveDepth = v
+				i++
+			}
+		case "time":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.Time = v
+				i++
+			}
+		case "nodes":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.Nodes = v
+				i++
+			}
+		case "pv":
+			s := make([]string, 0)
+			for i += 1; i < len(tokens) && strings.IndexAny(tokens[i], "12345678") >= 0; i++ {
+				s = append(s, tokens[i])
+			}
+			if len(s) > 0 {
+				info.PV = s
+			}
+		case "multipv":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.MultiPV = v
+				i++
+			}
+		case "score":
+			i++
+		loop:
+			for {
+				switch tokens[i] {
+				case "lowerbound":
+					info.Score.Bound = BoundLower
+					i++
+				case "upperbound":
+					info.Score.Bound = BoundUpper
+					i++
+				case "cp":
+					i++
+					if v, err := strconv.Atoi(tokens[i]); err == nil {
+						info.Score.Kind = ScoreCP
+						info.Score.Value = v
+						i++
+					}
+				case "mate":
+					i++
+					if v, err := strconv.Atoi(tokens[i]); err == nil {
+						info.Score.Kind = ScoreMate
+						info.Score.Value = v
+						i++
+					}
+				default:
+					break loop
+				}
+			}
+		case "wdl":
+			i++
+			var v [3]int
+			n := 0
+			for ; n < 3; n++ {
+				var err error
+				if v[n], err = strconv.Atoi(tokens[i]); err != nil {
+					break
+				}
+				i++
+			}
+			if n == 3 {
+				wdl = &WDL{Win: v[0], Draw: v[1], Loss: v[2]}
+			}
+		case "currmove":
+			info.CurrMove = tokens[i+1]
+			i += 2
+		case "currmovenumber":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.CurrMoveNumber = v
+				i++
+			}
+		case "hashfull":
+			i++
+			if v, err := strconv.ParseFloat(tokens[i], 32); err == nil {
+				info.Hashfull = float32(v)
+				i++
+			}
+		case "nps":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.NodesPerSec = v
+				i++
+			}
+		case "tbhits":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.TableBaseHits = v
+				i++
+			}
+		case "sbhits":
+			i++
+			if v, err := strconv.Atoi(tokens[i]); err == nil {
+				info.TableBaseHitsShredder = v
+				i++
+			}
+		case "cpuload":
+			i++
+			if v, err := strconv.ParseFloat(tokens[i], 32); err == nil {
+				info.Cpuload = float32(v)
+				i++
+			}
+		case "string":
+			info.Informational = tokens[i+1]
+			i += 2
+		case "refutation":
+			s := make([]string, 0)
+			for i += 1; i < len(tokens) && strings.IndexAny(tokens[i], "12345678") >= 0; i++ {
+				s = append(s, tokens[i])
+			}
+			if len(s) > 0 {
+				info.Refutation = s
+			}
+		case "currline":
+			s := make([]string, 0)
+			for i += 1; i < len(tokens) && strings.IndexAny(tokens[i], "12345678") >= 0; i++ {
+				s = append(s, tokens[i])
+			}
+			if len(s) > 0 {
+				info.CurrLine = s
+			}
+		default:
+			i++
+		}
+	}
+	if info.Score.Kind != ScoreNone {
+		info.Score.WDL = wdl
+	}
+	return info
+}
+
+func parseBestMoveLine(line string) (bestmove, ponder string) {
+	tokens := append(strings.Fields(line), "", "", "", "", "")
+	if tokens[0] == "bestmove" {
+		if tokens[2] == "ponder" {
+			return tokens[1], tokens[3]
+		}
+		return tokens[1], ""
+	}
+	return "", ""
+}
+
+// fail kills the engine after err happened in phase and describes it.
+func (eng *UCIEngine) fail(phase string, err error) error {
+	eng.kill()
+	return &UCIError{Phase: phase, Err: err, Stderr: eng.stderr.String()}
+}
+
+// restartAfter starts a fresh engine if err killed the current one. If
+// that fails too the engine stays down and the next request retries.
+func (eng *UCIEngine) restartAfter(err error) error {
+	var uerr *UCIError
+	if errors.As(err, &uerr) && eng.cmd == nil {
+		if rerr := eng.start(); rerr != nil {
+			return fmt.Errorf("%w; restart failed: %v", err, rerr)
+		}
+	}
+	return err
+}
+
+func (eng *UCIEngine) send(phase string, args ...interface{}) error {
+	if _, err := fmt.Fprintln(eng.w, args...); err != nil {
+		return eng.fail(phase, err)
+	}
+	return nil
+}
+
+// deadline fires after Timeout, or never if there is no Timeout.
+func (eng *UCIEngine) deadline() <-chan time.Time {
+	if eng.Timeout <= 0 {
+		return nil
+	}
+	return time.After(eng.Timeout)
+}
+
+func (eng *UCIEngine) readLine(phase string) (string, error) {
+	select {
+	case line, ok := <-eng.lines:
+		if !ok {
+			return "", eng.fail(phase, eng.readErr)
+		}
+		return line, nil
+	case <-eng.deadline():
+		return "", eng.fail(phase, ErrEngineTimeout)
+	}
+}
+
+// waitEngineToGetReady sends 'isready' and reads the 'readyok'. If ctx
+// is cancelled first, nothing is running in the engine yet, so it is
+// left alone and the 'readyok' it owes is read by the next call.
+func (eng *UCIEngine) waitEngineToGetReady(ctx context.Context) error {
+	if err := eng.send("isready", "isready"); err != nil {
+		return err
+	}
+	eng.unready++
+	for eng.unready > 0 {
+		select {
+		case line, ok := <-eng.lines:
+			if !ok {
+				return eng.fail("isready", eng.readErr)
+			}
+			if !strings.HasPrefix(line, "readyok") {
+				return eng.fail("isready", fmt.Errorf("waitEngineToGetReady did not return 'readyok' but '%s'", line))
+			}
+			eng.unready--
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-eng.deadline():
+			return eng.fail("isready", ErrEngineTimeout)
+		}
+	}
+	return nil
+}
+
+func parseOptionLine(line string) (UCIOption, error) {
+	var opt UCIOption
+	var key string
+	var values []string
+	set := func() {
+		value := strings.Join(values, " ")
+		switch key {
+		case "name":
+			opt.Name = value
+		case "type":
+			opt.Type = UCIOptionType(value)
+		case "default":
+			opt.Default = value
+		case "min":
+			opt.Min, _ = strconv.Atoi(value)
+		case "max":
+			opt.Max, _ = strconv.Atoi(value)
+		case "var":
+			opt.Vars = append(opt.Vars, value)
+		}
+		values = values[:0]
+	}
+	for _, token := range strings.Fields(line)[1:] {
+		switch token {
+		case "name", "type", "default", "min", "max", "var":
+			// the name itself may contain keywords, only 'type' ends it
+			if key != "name" || token == "type" {
+				set()
+				key = token
+				continue
+			}
+		}
+		values = append(values, token)
+	}
+	set()
+
+	switch opt.Type {
+	case OptionCheck, OptionSpin, OptionCombo, OptionButton, OptionString:
+	default:
+		return opt, fmt.Errorf("option '%s' has unknown type '%s'", opt.Name, opt.Type)
+	}
+	if opt.Name == "" {
+		return opt, fmt.Errorf("cannot understand option line: '%s'", line)
+	}
+	return opt, nil
+}
+
+func (eng *UCIEngine) resetEngine(ctx context.Context, options map[string]string) error {
+	if err := eng.send("uci", "uci"); err != nil {
+		return err
+	}
+	eng.Info = EngineInfo{Options: make(map[string]UCIOption)}
+	for {
+		line, err := eng.readLine("uci")
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "uciok") {
+			break
+		} else if strings.HasPrefix(line, "id name ") {
+			eng.Info.Name = strings.TrimSpace(line[len("id name "):])
+		} else if strings.HasPrefix(line, "id author ") {
+			eng.Info.Author = strings.TrimSpace(line[len("id author "):])
+		} else if strings.HasPrefix(line, "option ") {
+			opt, err := parseOptionLine(line)
+			if err != nil {
+				return eng.fail("uci", err)
+			}
+			eng.Info.Options[strings.ToLower(opt.Name)] = opt
+		}
+	}
+	for k, v := range options {
+		if err := eng.setOption(k, v); err != nil {
+			if eng.cmd != nil {
+				eng.kill()
+			}
+			return err
+		}
+	}
+	if err := eng.waitEngineToGetReady(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetOption checks value against the option the engine declared and
+// sends it. Buttons take an empty value. Options are set again when the
+// engine is restarted.
+func (eng *UCIEngine) SetOption(name, value string) error {
+	if eng.cmd == nil {
+		if err := eng.start(); err != nil {
+			return err
+		}
+	}
+	return eng.restartAfter(eng.setOption(name, value))
+}
+
+func (eng *UCIEngine) setOption(name, value string) error {
+	opt, ok := eng.Info.Options[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("engine %s has no option '%s'", eng.Info.Name, name)
+	}
+	switch opt.Type {
+	case OptionCheck:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("option '%s' is a check and cannot be '%s'", opt.Name, value)
+		}
+	case OptionSpin:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("option '%s' is a spin and cannot be '%s'", opt.Name, value)
+		}
+		if v < opt.Min || v > opt.Max {
+			return fmt.Errorf("option '%s' must be in [%d, %d] not %d", opt.Name, opt.Min, opt.Max, v)
+		}
+	case OptionCombo:
+		found := false
+		for _, v := range opt.Vars {
+			if strings.EqualFold(v, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("option '%s' must be one of %v not '%s'", opt.Name, opt.Vars, value)
+		}
+	case OptionButton:
+		if value != "" {
+			return fmt.Errorf("option '%s' is a button and takes no value", opt.Name)
+		}
+		return eng.send("setoption", "setoption name", opt.Name)
+	}
+	if err := eng.send("setoption", "setoption name", opt.Name, "value", value); err != nil {
+		return err
+	}
+	eng.options[opt.Name] = value
+	return nil
+}
+
+func NewUCIEngine(path string, options map[string]string) (*UCIEngine, error) {
+	eng := &UCIEngine{path: path, options: options, Timeout: 30 * time.Second}
+	if err := eng.start(); err != nil {
+		return nil, err
+	}
+	return eng, nil
+}
+
+// execCommand makes the command that runs an engine. Tests replace it to
+// run a fake engine.
+var execCommand = exec.Command
+
+func (eng *UCIEngine) start() error {
+	cmd := execCommand(eng.path)
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	eng.stderr = &tailBuffer{max: 1024}
+	cmd.Stderr = eng.stderr
+	if err := cmd.Start(); err != nil {
+		return &UCIError{Phase: "start", Err: err}
+	}
+	eng.cmd = cmd
+	eng.w = w
+	eng.lines = make(chan string)
+	eng.unready = 0
+	options := eng.options
+	eng.options = make(map[string]string)
+	go func(lines chan<- string) {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				eng.readErr = err
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}(eng.lines)
+	if err := eng.resetEngine(context.Background(), options); err != nil {
+		eng.options = options
+		return err
+	}
+	return nil
+}
+
+func (pos UCIPosition) command() string {
+	cmd := ""
+	if pos.FEN == "startpos" {
+		cmd += "position startpos"
+	} else {
+		cmd += "position fen " + pos.FEN
+	}
+	if pos.Moves != nil {
+		cmd += " moves"
+		for _, move := range pos.Moves {
+			cmd += " " + move
+		}
+	}
+	return cmd
+}
+
+func (limits SearchLimits) command() string {
+	cmd := "go"
+	if len(limits.SearchMoves) > 0 {
+		cmd += " searchmoves " + strings.Join(limits.SearchMoves, " ")
+	}
+	if limits.Ponder {
+		cmd += " ponder"
+	}
+	if limits.WTime > 0 || limits.BTime > 0 {
+		cmd += fmt.Sprint(" wtime ", limits.WTime, " btime ", limits.BTime)
+	}
+	for _, arg := range []struct {
+		name  string
+		value int
+	}{
+		{"winc", limits.WInc},
+		{"binc", limits.BInc},
+		{"movestogo", limits.MovesToGo},
+		{"depth", limits.Depth},
+		{"nodes", limits.Nodes},
+		{"mate", limits.Mate},
+		{"movetime", limits.MoveTime},
+	} {
+		if arg.value > 0 {
+			cmd += fmt.Sprint(" ", arg.name, " ", arg.value)
+		}
+	}
+	if limits.Infinite {
+		cmd += " infinite"
+	}
+	return cmd
+}
+
+// bounded reports whether a search with these limits ends on its own,
+// without a 'stop' or 'ponderhit' from us.
+func (limits SearchLimits) bounded() bool {
+	if limits.Infinite || limits.Ponder {
+		return false
+	}
+	return limits.WTime > 0 || limits.BTime > 0 || limits.Depth > 0 ||
+		limits.Nodes > 0 || limits.Mate > 0 || limits.MoveTime > 0
+}
+
+// StartAnalysis sets up the position and starts searching it. When ctx is
+// cancelled the engine is sent 'stop' and the analysis ends with the best
+// move found so far; if that happens before the search starts, the error
+// is ctx.Err() and the engine is kept as it is. The engine must not be
+// used again until Wait returns.
+//
+// An engine that crashes or hangs, as Timeout tells, is restarted and
+// the error returned by Wait is a *UCIError. Positions that do not validate
+// are not sent and fail with a *PositionError.
+func (eng *UCIEngine) StartAnalysis(ctx context.Context, pos UCIPosition, limits SearchLimits) (*UCIAnalysis, error) {
+	start, err := pos.Validate()
+	if err != nil {
+		return nil, err
+	}
+	for _, uci := range limits.SearchMoves {
+		if _, err := start.ParseUCI(uci); err != nil {
+			return nil, fmt.Errorf("searchmoves: %v", err)
+		}
+	}
+	if eng.cmd == nil {
+		if err := eng.start(); err != nil {
+			return nil, err
+		}
+	}
+	if pos.NewGame {
+		if err := eng.send("ucinewgame", "ucinewgame"); err != nil {
+			return nil, eng.restartAfter(err)
+		}
+	}
+	multiPV := limits.MultiPV
+	if multiPV <= 0 {
+		multiPV = 1
+	}
+	if sent, ok := eng.options["MultiPV"]; (ok || multiPV > 1) && sent != strconv.Itoa(multiPV) {
+		if err := eng.setOption("MultiPV", strconv.Itoa(multiPV)); err != nil {
+			return nil, eng.restartAfter(err)
+		}
+	}
+	if err := eng.send("position", pos.command()); err != nil {
+		return nil, eng.restartAfter(err)
+	}
+	if err := eng.waitEngineToGetReady(ctx); err != nil {
+		return nil, eng.restartAfter(err)
+	}
+	if err := eng.send("go", limits.command()); err != nil {
+		return nil, eng.restartAfter(err)
+	}
+
+	infos := make(chan tUCIInfo, 16)
+	a := &UCIAnalysis{Info: infos, start: start, done: make(chan struct{})}
+	if limits.Ponder {
+		a.ponderhit = make(chan struct{})
+	}
+	go func() {
+		defer close(a.done)
+		defer close(infos)
+		a.err = eng.restartAfter(eng.search(ctx, limits, infos, a))
+	}()
+	return a, nil
+}
+
+func (eng *UCIEngine) search(ctx context.Context, limits SearchLimits, infos chan<- tUCIInfo, a *UCIAnalysis) error {
+	var timer *time.Timer
+	var hang <-chan time.Time
+	hangIn := func(d time.Duration) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(d)
+		hang = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	// idle is set when the search has no time limit and the engine may
+	// only be quiet for Timeout
+	idle := false
+	hangAfter := func() {
+		if eng.Timeout <= 0 {
+			return
+		}
+		switch {
+		case limits.MoveTime > 0:
+			hangIn(time.Duration(limits.MoveTime)*time.Millisecond + eng.Timeout)
+		case limits.WTime > 0 || limits.BTime > 0:
+			clock, inc := limits.WTime, limits.WInc
+			if a.start.Turn == chess.Black {
+				clock, inc = limits.BTime, limits.BInc
+			}
+			hangIn(time.Duration(clock+inc)*time.Millisecond + eng.Timeout)
+		case limits.Depth > 0 || limits.Nodes > 0 || limits.Mate > 0:
+			idle = true
+			hangIn(eng.Timeout)
+		}
+	}
+	ponderhit := a.ponderhit
+	if ponderhit == nil {
+		hangAfter()
+	}
+	cancel := ctx.Done()
+	for {
+		select {
+		case line, ok := <-eng.lines:
+			if !ok {
+				return eng.fail("search", eng.readErr)
+			}
+			if strings.HasPrefix(line, "info") {
+				if idle {
+					hangIn(eng.Timeout)
+				}
+				infos <- parseInfoLine(line)
+			} else if strings.HasPrefix(line, "bestmove") {
+				a.eval.BestMove, a.eval.PonderMove = parseBestMoveLine(line)
+				return nil
+			} else {
+				return eng.fail("search", fmt.Errorf("cannot understand line: '%s'", line))
+			}
+		case <-ponderhit:
+			ponderhit = nil
+			if err := eng.send("ponderhit", "ponderhit"); err != nil {
+				return err
+			}
+			hangAfter()
+		case <-cancel:
+			cancel, ponderhit = nil, nil
+			if err := eng.send("stop", "stop"); err != nil {
+				return err
+			}
+			idle, hang = false, nil
+			if eng.Timeout > 0 {
+				hangIn(eng.Timeout)
+			}
+		case <-hang:
+			return eng.fail("search", ErrEngineTimeout)
+		}
+	}
+}
+
+func (eng *UCIEngine) EvaluatePosition(ctx context.Context, newgame bool, fen string, moves []string, limits SearchLimits) (UCIPositionEvaluation, error) {
+	if !limits.bounded() {
+		return UCIPositionEvaluation{}, fmt.Errorf("EvaluatePosition needs limits that end the search, not '%s'", limits.command())
+	}
+	pos := UCIPosition{NewGame: newgame, FEN: fen, Moves: moves}
+	a, err := eng.StartAnalysis(ctx, pos, limits)
+	if err != nil {
+		return UCIPositionEvaluation{}, err
+	}
+	return a.Result()
+}
+
+// Result waits for the analysis to end and returns the best move with
+// the last variation the engine sent for each rank.
+func (a *UCIAnalysis) Result() (UCIPositionEvaluation, error) {
+	pvs := make(map[int]tUCIInfo)
+	for info := range a.Info {
+		if info.PV != nil {
+			pvs[info.MultiPV] = info
+		}
+	}
+	eval, err := a.Wait()
+	if err != nil {
+		return eval, err
+	}
+	for _, info := range pvs {
+		eval.Variations = append(eval.Variations, UCIVariation{
+			Rank:           info.MultiPV,
+			Score:          info.Score,
+			Moves:          info.PV,
+			SAN:            sanLine(a.start, info.PV),
+			Depth:          info.Depth,
+			SelectiveDepth: info.SelectiveDepth,
+			Nodes:          info.Nodes,
+		})
+	}
+	sort.Slice(eval.Variations, func(i, j int) bool {
+		return eval.Variations[i].Rank < eval.Variations[j].Rank
+	})
+	return eval, nil
+}
+
+func (eng *UCIEngine) Close() error {
+	if eng.cmd == nil {
+		return nil
+	}
+	fmt.Fprintln(eng.w, "quit")
+	timeout := eng.deadline()
+	for {
+		select {
+		case _, ok := <-eng.lines:
+			if ok {
+				continue
+			}
+			err := eng.cmd.Wait()
+			eng.cmd = nil
+			return err
+		case <-timeout:
+			return eng.fail("quit", ErrEngineTimeout)
+		}
+	}
+}
+
+// kill stops a misbehaving engine and waits for its output to end.
+func (eng *UCIEngine) kill() {
+	eng.cmd.Process.Kill()
+	for range eng.lines {
+	}
+	eng.cmd.Wait()
+	eng.cmd = nil
+}
+
+// Settings identifies the options that are not at their default, other
+// than MultiPV which every search sets for itself. It is empty if there
+// are none. Engines of the same name and settings evaluate alike.
+func (eng *UCIEngine) Settings() string {
+	var set []string
+	for name, value := range eng.options {
+		opt := eng.Info.Options[strings.ToLower(name)]
+		if strings.EqualFold(name, "MultiPV") || strings.EqualFold(value, opt.Default) {
+			continue
+		}
+		set = append(set, strings.ToLower(name)+"="+value)
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	sort.Strings(set)
+	sum := sha1.Sum([]byte(strings.Join(set, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// EnginePool runs the same engine in many processes. Engines that crash
+// or hang are restarted by UCIEngine itself.
+type EnginePool struct {
+	// Cache, if set, is asked before the engines and saved on Close.
+	Cache *EvalCache
+	// Tablebase, if set, answers the positions it covers. The engines
+	// get them only if probing fails.
+	Tablebase *Tablebase
+
+	name     string
+	settings string
+	engines  chan *UCIEngine
+}
+
+type PoolResult struct {
+	Eval UCIPositionEvaluation
+	Err  error
+}
+
+// NewEnginePool starts n engines, or one per cpu if n <= 0.
+func NewEnginePool(path string, options map[string]string, n int) (*EnginePool, error) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	p := &EnginePool{engines: make(chan *UCIEngine, n)}
+	for i := 0; i < n; i++ {
+		eng, err := NewUCIEngine(path, options)
+		if err != nil {
+			for ; i < n; i++ {
+				p.engines <- nil
+			}
+			p.Close()
+			return nil, err
+		}
+		p.engines <- eng
+		p.name, p.settings = eng.Info.Name, eng.Settings()
+	}
+	return p, nil
+}
+
+// Info is what the engines of the pool tell about themselves.
+func (p *EnginePool) Info() EngineInfo {
+	eng := <-p.engines
+	defer func() { p.engines <- eng }()
+	return eng.Info
+}
+
+// SetTimeout sets the Timeout of every engine in the pool.
+func (p *EnginePool) SetTimeout(d time.Duration) {
+	for n := cap(p.engines); n > 0; n-- {
+		eng := <-p.engines
+		defer func() { p.engines <- eng }()
+		eng.Timeout = d
+	}
+}
+
+// Acquire waits for a free engine, which must be given back by Release.
+func (p *EnginePool) Acquire(ctx context.Context) (*UCIEngine, error) {
+	select {
+	case eng := <-p.engines:
+		return eng, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *EnginePool) Release(eng *UCIEngine) {
+	p.engines <- eng
+}
+
+// Size is the number of engines and Idle the number of free ones.
+func (p *EnginePool) Size() int { return cap(p.engines) }
+func (p *EnginePool) Idle() int { return len(p.engines) }
+
+// Lookup answers pos from the tablebase or the cache without searching,
+// if either can.
+func (p *EnginePool) Lookup(ctx context.Context, pos UCIPosition, limits SearchLimits) (UCIPositionEvaluation, bool) {
+	if p.Tablebase != nil && tablebaseAnswers(limits) {
+		if start, err := pos.Validate(); err == nil && p.Tablebase.Covers(start) {
+			if eval, err := p.Tablebase.Probe(ctx, start); err == nil {
+				return eval, true
+			}
+		}
+	}
+	if p.Cache != nil {
+		if eval, ok := p.Cache.Get(p.name, p.settings, pos, limits); ok {
+			return eval, true
+		}
+	}
+	return UCIPositionEvaluation{}, false
+}
+
+// Store caches the evaluation of a search that was not cancelled.
+func (p *EnginePool) Store(ctx context.Context, pos UCIPosition, limits SearchLimits, eval UCIPositionEvaluation) {
+	if p.Cache != nil && ctx.Err() == nil {
+		p.Cache.Put(p.name, p.settings, pos, limits, eval)
+	}
+}
+
+// Evaluate runs on the first free engine. If the engine fails it is
+// restarted and the position is tried once more.
+func (p *EnginePool) Evaluate(ctx context.Context, pos UCIPosition, limits SearchLimits) (UCIPositionEvaluation, error) {
+	if eval, ok := p.Lookup(ctx, pos, limits); ok {
+		return eval, nil
+	}
+	eng, err := p.Acquire(ctx)
+	if err != nil {
+		return UCIPositionEvaluation{}, err
+	}
+	defer p.Release(eng)
+	eval, err := eng.EvaluatePosition(ctx, pos.NewGame, pos.FEN, pos.Moves, limits)
+	var uerr *UCIError
+	if errors.As(err, &uerr) && ctx.Err() == nil {
+		eval, err = eng.EvaluatePosition(ctx, pos.NewGame, pos.FEN, pos.Moves, limits)
+	}
+	if err == nil {
+		p.Store(ctx, pos, limits, eval)
+	}
+	return eval, err
+}
+
+// EvaluateAll spreads positions over the pool and returns the results in
+// the same order.
+func (p *EnginePool) EvaluateAll(ctx context.Context, positions []UCIPosition, limits SearchLimits) []PoolResult {
+	results := make([]PoolResult, len(positions))
+	var wg sync.WaitGroup
+	for i, pos := range positions {
+		wg.Add(1)
+		go func(i int, pos UCIPosition) {
+			defer wg.Done()
+			results[i].Eval, results[i].Err = p.Evaluate(ctx, pos, limits)
+		}(i, pos)
+	}
+	wg.Wait()
+	return results
+}
+
+func (p *EnginePool) Close() error {
+	var err error
+	if p.Cache != nil {
+		err = p.Cache.Save()
+	}
+	for n := cap(p.engines); n > 0; n-- {
+		if eng := <-p.engines; eng != nil {
+			if e := eng.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
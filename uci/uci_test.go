@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The engines of the tests are fake ones, played from a script by the
+// test binary itself: the engine path is the script, and execCommand
+// runs TestHelperEngine with it.
+func init() {
+	execCommand = func(script string, args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperEngine$", "--", script)
+		cmd.Env = append(os.Environ(), "UCI_HELPER_ENGINE=1")
+		return cmd
+	}
+}
+
+// fakeEngine plays an engine from a script, to try the client against
+// engines that misbehave. The script is made of blocks, each starting
+// with '> prefix' and answering the commands whose first words are
+// prefix:
+//
+//	> uci
+//	< id name FakeFish
+//	< uciok
+//	> isready
+//	< readyok
+//	> go
+//	< info depth 1 score cp 20 pv e2e4
+//	sleep 100ms
+//	< bestmove e2e4
+//
+// Lines starting with '<' are written to stdout as they are. The other
+// steps are 'sleep duration', 'stderr text', 'crash [code]', 'hang',
+// which stops answering anything, and 'wait prefix|prefix...', which
+// ignores commands until one with a prefix arrives. A command is
+// answered by the blocks with the longest prefix that matches it, in
+// order, and the last one is repeated. Commands without a block, except
+// 'quit', are ignored. Lines starting with '#' are comments.
+type fakeEngine struct {
+	blocks []*fakeBlock
+}
+
+type fakeBlock struct {
+	prefix string
+	steps  []string
+	used   bool
+}
+
+func parseFakeScript(script string) (*fakeEngine, error) {
+	f := new(fakeEngine)
+	var b *fakeBlock
+	for n, line := range strings.Split(script, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, ">") {
+			b = &fakeBlock{prefix: strings.TrimSpace(line[1:])}
+			f.blocks = append(f.blocks, b)
+			continue
+		}
+		if b == nil {
+			return nil, fmt.Errorf("line %d: '%s' is not in a block", n+1, line)
+		}
+		if !strings.HasPrefix(line, "<") {
+			op := strings.Fields(line)[0]
+			switch op {
+			case "sleep", "stderr", "crash", "hang", "wait":
+			default:
+				return nil, fmt.Errorf("line %d: unknown step '%s'", n+1, op)
+			}
+		}
+		b.steps = append(b.steps, line)
+	}
+	return f, nil
+}
+
+func hasCommandPrefix(cmd, prefix string) bool {
+	return cmd == prefix || strings.HasPrefix(cmd, prefix+" ")
+}
+
+// block finds the block that answers cmd.
+func (f *fakeEngine) block(cmd string) *fakeBlock {
+	longest := -1
+	for _, b := range f.blocks {
+		if hasCommandPrefix(cmd, b.prefix) && len(b.prefix) > longest {
+			longest = len(b.prefix)
+		}
+	}
+	var last *fakeBlock
+	for _, b := range f.blocks {
+		if len(b.prefix) == longest && hasCommandPrefix(cmd, b.prefix) {
+			if !b.used {
+				b.used = true
+				return b
+			}
+			last = b
+		}
+	}
+	return last
+}
+
+func (f *fakeEngine) run(cmds <-chan string) {
+	for cmd := range cmds {
+		if cmd == "quit" {
+			return
+		}
+		b := f.block(cmd)
+		if b == nil {
+			continue
+		}
+		for _, step := range b.steps {
+			if strings.HasPrefix(step, "<") {
+				fmt.Println(strings.TrimPrefix(strings.TrimPrefix(step, "<"), " "))
+				continue
+			}
+			op := strings.Fields(step)[0]
+			arg := strings.TrimSpace(step[len(op):])
+			switch op {
+			case "sleep":
+				d, _ := time.ParseDuration(arg)
+				time.Sleep(d)
+			case "stderr":
+				fmt.Fprintln(os.Stderr, arg)
+			case "crash":
+				code, err := strconv.Atoi(arg)
+				if err != nil {
+					code = 1
+				}
+				os.Exit(code)
+			case "hang":
+				select {}
+			case "wait":
+			wait:
+				for c := range cmds {
+					if c == "quit" {
+						return
+					}
+					for _, prefix := range strings.Split(arg, "|") {
+						if hasCommandPrefix(c, prefix) {
+							break wait
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestHelperEngine is the fake engine, when run by execCommand.
+func TestHelperEngine(t *testing.T) {
+	if os.Getenv("UCI_HELPER_ENGINE") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: TestHelperEngine -- script")
+		os.Exit(2)
+	}
+	f, err := parseFakeScript(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cmds := make(chan string)
+	go func() {
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			cmds <- strings.TrimSpace(s.Text())
+		}
+		close(cmds)
+	}()
+	f.run(cmds)
+	os.Exit(0)
+}
+
+const fakeHandshake = `
+> uci
+< id name FakeFish 1.0
+< id author The Fakers
+< option name Hash type spin default 16 min 1 max 1024
+< option name MultiPV type spin default 1 min 1 max 500
+< option name Ponder type check default false
+< option name Style type combo default Normal var Solid var Normal var Risky
+< option name Clear Hash type button
+< uciok
+`
+
+const fakeReady = `
+> isready
+< readyok
+`
+
+const fakeSearch = `
+> go
+< info depth 1 seldepth 2 multipv 1 score cp 10 nodes 100 pv e2e4 e7e5
+< info depth 1 seldepth 2 multipv 2 score cp 5 nodes 100 pv d2d4 d7d5
+< info depth 2 seldepth 3 multipv 1 score cp 25 upperbound nodes 300 pv e2e4
+< info depth 2 seldepth 4 multipv 1 score cp 20 wdl 300 500 200 nodes 500 pv e2e4 e7e5 g1f3
+< info depth 2 seldepth 4 multipv 2 score mate -3 nodes 500 pv f2f3 e7e5
+< bestmove e2e4 ponder e7e5
+`
+
+func startFake(t *testing.T, script string, options map[string]string) *UCIEngine {
+	t.Helper()
+	eng, err := NewUCIEngine(script, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eng
+}
+
+// uciError checks that err is a *UCIError at phase.
+func uciError(t *testing.T, err error, phase string) *UCIError {
+	t.Helper()
+	var uerr *UCIError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("error is %v, want a UCIError", err)
+	}
+	if uerr.Phase != phase {
+		t.Errorf("error is at %s, want %s: %v", uerr.Phase, phase, err)
+	}
+	return uerr
+}
+
+func TestParseInfoLine(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want tUCIInfo
+	}{
+		{"info depth 12 seldepth 18 multipv 2 score cp -35 nodes 123456 nps 1000 time 120 pv e2e4 e7e5",
+			tUCIInfo{MultiPV: 2, Depth: 12, SelectiveDepth: 18, Score: Score{Kind: ScoreCP, Value: -35},
+				Nodes: 123456, NodesPerSec: 1000, Time: 120, PV: []string{"e2e4", "e7e5"}}},
+		{"info depth 30 score mate 4 lowerbound pv h5f7",
+			tUCIInfo{MultiPV: 1, Depth: 30, Score: Score{Kind: ScoreMate, Value: 4, Bound: BoundLower}, PV: []string{"h5f7"}}},
+		{"info score cp 12 upperbound wdl 250 600 150",
+			tUCIInfo{MultiPV: 1, Score: Score{Kind: ScoreCP, Value: 12, Bound: BoundUpper, WDL: &WDL{250, 600, 150}}}},
+		{"info wdl 1 2 3",
+			tUCIInfo{MultiPV: 1}},
+		{"info currmove g1f3 currmovenumber 3 hashfull 512 tbhits 7",
+			tUCIInfo{MultiPV: 1, CurrMove: "g1f3", CurrMoveNumber: 3, Hashfull: 512, TableBaseHits: 7}},
+		{"info depth x nodes 10 pv",
+			tUCIInfo{MultiPV: 1, Nodes: 10}},
+		{"info",
+			tUCIInfo{MultiPV: 1}},
+	} {
+		if got := parseInfoLine(c.line); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseInfoLine(%q) = %+v, want %+v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestParseBestMoveLine(t *testing.T) {
+	for _, c := range []struct {
+		line, best, ponder string
+	}{
+		{"bestmove e2e4", "e2e4", ""},
+		{"bestmove e7e8q ponder a2a1n", "e7e8q", "a2a1n"},
+		{"bestmove (none)", "(none)", ""},
+		{"bestmove", "", ""},
+		{"info depth 1", "", ""},
+	} {
+		if best, ponder := parseBestMoveLine(c.line); best != c.best || ponder != c.ponder {
+			t.Errorf("parseBestMoveLine(%q) = %q, %q, want %q, %q", c.line, best, ponder, c.best, c.ponder)
+		}
+	}
+}
+
+func TestResetEngine(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady, map[string]string{"hash": "64", "Style": "risky"})
+	defer eng.Close()
+	if eng.Info.Name != "FakeFish 1.0" || eng.Info.Author != "The Fakers" {
+		t.Errorf("engine is %s by %s", eng.Info.Name, eng.Info.Author)
+	}
+	if len(eng.Info.Options) != 5 {
+		t.Errorf("engine has %d options, want 5", len(eng.Info.Options))
+	}
+	if vars := eng.Info.Options["style"].Vars; !reflect.DeepEqual(vars, []string{"Solid", "Normal", "Risky"}) {
+		t.Errorf("Style is one of %v", vars)
+	}
+	if typ := eng.Info.Options["clear hash"].Type; typ != OptionButton {
+		t.Errorf("Clear Hash is a %s", typ)
+	}
+	if want := map[string]string{"Hash": "64", "Style": "risky"}; !reflect.DeepEqual(eng.options, want) {
+		t.Errorf("options set are %v, want %v", eng.options, want)
+	}
+	for _, bad := range [][2]string{{"Hash", "2048"}, {"Hash", "big"}, {"Ponder", "yes"}, {"Style", "Wild"}, {"Clear Hash", "1"}, {"Contempt", "10"}} {
+		if err := eng.SetOption(bad[0], bad[1]); err == nil {
+			t.Errorf("SetOption(%s, %s) did not fail", bad[0], bad[1])
+		}
+	}
+	if err := eng.SetOption("Clear Hash", ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResetEngineErrors(t *testing.T) {
+	if _, err := NewUCIEngine(fakeHandshake+fakeReady, map[string]string{"Hash": "0"}); err == nil {
+		t.Error("engine started with Hash 0")
+	}
+	_, err := NewUCIEngine(fakeHandshake+"> isready\n< readyno\n", nil)
+	uciError(t, err, "isready")
+
+	eng := startFake(t, fakeHandshake+"> isready\nsleep 300ms\n< readyok\n", nil)
+	if err := eng.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		pos  UCIPosition
+		ply  int
+		move string
+	}{
+		{UCIPosition{FEN: "8/8/8/8/8/8/8/8 w - - 0 1"}, 0, ""},
+		{UCIPosition{FEN: "startpos", Moves: []string{"e2e4", "e7e5", "e1e2", "e8e7", "e2e1", "e7e8", "e1g1"}}, 7, "e1g1"},
+		{UCIPosition{FEN: "4k3/8/8/8/8/8/8/4K3 w - - 0 1", Moves: []string{"e1e2", "e8e9"}}, 2, "e8e9"},
+	} {
+		_, err := c.pos.Validate()
+		var perr *PositionError
+		if !errors.As(err, &perr) {
+			t.Errorf("%v: error is %v, want a PositionError", c.pos, err)
+			continue
+		}
+		if perr.Ply != c.ply || perr.Move != c.move {
+			t.Errorf("%v: bad move is %d %s, want %d %s", c.pos, perr.Ply, perr.Move, c.ply, c.move)
+		}
+	}
+	p, err := UCIPosition{FEN: "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1"}.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"O-O", "O-O-O", "Ra7", "Rd1", "Rxd1"}
+	if san := sanLine(p, []string{"e1g1", "e8c8", "a1a7", "d8d1", "f1d1", "h8h9"}); !reflect.DeepEqual(san, want) {
+		t.Errorf("SAN line is %v, want %v", san, want)
+	}
+}
+
+func TestEvaluatePosition(t *testing.T) {
+	eng := startFake(t, fakeHandshake+"> isready\nsleep 50ms\n< readyok\n"+fakeSearch, nil)
+	defer eng.Close()
+	if _, err := eng.EvaluatePosition(context.Background(), true, "startpos", nil, SearchLimits{Infinite: true}); err == nil {
+		t.Error("infinite search was accepted")
+	}
+	eval, err := eng.EvaluatePosition(context.Background(), true, "startpos", nil, SearchLimits{Depth: 2, MultiPV: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UCIPositionEvaluation{
+		BestMove:   "e2e4",
+		PonderMove: "e7e5",
+		Variations: []UCIVariation{
+			{Rank: 1, Score: Score{Kind: ScoreCP, Value: 20, WDL: &WDL{300, 500, 200}},
+				Moves: []string{"e2e4", "e7e5", "g1f3"}, SAN: []string{"e4", "e5", "Nf3"}, Depth: 2, SelectiveDepth: 4, Nodes: 500},
+			{Rank: 2, Score: Score{Kind: ScoreMate, Value: -3},
+				Moves: []string{"f2f3", "e7e5"}, SAN: []string{"f3", "e5"}, Depth: 2, SelectiveDepth: 4, Nodes: 500},
+		},
+	}
+	if !reflect.DeepEqual(eval, want) {
+		t.Errorf("evaluation is %+v, want %+v", eval, want)
+	}
+	if eng.options["MultiPV"] != "2" {
+		t.Errorf("MultiPV is %s, want 2", eng.options["MultiPV"])
+	}
+	// a search without MultiPV goes back to one line
+	if _, err := eng.EvaluatePosition(context.Background(), false, "startpos", nil, SearchLimits{Depth: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if eng.options["MultiPV"] != "1" {
+		t.Errorf("MultiPV is %s, want 1", eng.options["MultiPV"])
+	}
+}
+
+func TestEvaluatePositionBadPosition(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+fakeSearch, nil)
+	defer eng.Close()
+	_, err := eng.EvaluatePosition(context.Background(), false, "startpos", []string{"e2e4", "e2e4"}, SearchLimits{Depth: 1})
+	var perr *PositionError
+	if !errors.As(err, &perr) || perr.Ply != 2 {
+		t.Errorf("error is %v, want a PositionError at ply 2", err)
+	}
+	// the engine was not bothered with the bad position
+	if _, err := eng.EvaluatePosition(context.Background(), false, "startpos", nil, SearchLimits{Depth: 1}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestEvaluatePositionFailures runs engines that fail in the search. Each
+// must be killed and restarted with its options.
+func TestEvaluatePositionFailures(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		search string
+		limits SearchLimits
+		err    error
+		stderr string
+	}{
+		{"malformed line", "> go\n< info depth 1 pv e2e4\n< Segmentation fault\n", SearchLimits{Depth: 1}, nil, ""},
+		{"crash", "> go\n< info depth 1 pv e2e4\nstderr assertion failed: board.cpp:42\ncrash 134\n",
+			SearchLimits{Depth: 1}, nil, "assertion failed: board.cpp:42"},
+		{"hang in movetime", "> go\n< info depth 1 pv e2e4\nhang\n", SearchLimits{MoveTime: 100}, ErrEngineTimeout, ""},
+		{"hang on the clock", "> go\n< info depth 1 pv e2e4\nhang\n", SearchLimits{WTime: 100, BTime: 5000}, ErrEngineTimeout, ""},
+		{"hang in depth", "> go\n< info depth 1 pv e2e4\nhang\n", SearchLimits{Depth: 20}, ErrEngineTimeout, ""},
+		{"hang in nodes", "> go\nhang\n", SearchLimits{Nodes: 1000000}, ErrEngineTimeout, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			eng := startFake(t, fakeHandshake+fakeReady+c.search, map[string]string{"Hash": "64"})
+			defer eng.Close()
+			eng.Timeout = 200 * time.Millisecond
+			_, err := eng.EvaluatePosition(context.Background(), false, "startpos", nil, c.limits)
+			uerr := uciError(t, err, "search")
+			if c.err != nil && uerr.Err != c.err {
+				t.Errorf("error is %v, want %v", uerr.Err, c.err)
+			}
+			if uerr.Stderr != c.stderr {
+				t.Errorf("stderr is %q, want %q", uerr.Stderr, c.stderr)
+			}
+			if eng.cmd == nil {
+				t.Fatal("engine was not restarted")
+			}
+			if want := map[string]string{"Hash": "64"}; !reflect.DeepEqual(eng.options, want) {
+				t.Errorf("options after restart are %v, want %v", eng.options, want)
+			}
+		})
+	}
+}
+
+// TestEvaluatePositionSlow runs a search by depth longer than Timeout, in
+// which the engine is never quiet for that long.
+func TestEvaluatePositionSlow(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+`
+> go
+< info depth 1 score cp 10 pv e2e4
+sleep 150ms
+< info depth 2 score cp 12 pv e2e4
+sleep 150ms
+< info depth 3 score cp 14 pv e2e4
+sleep 150ms
+< bestmove e2e4
+`, nil)
+	defer eng.Close()
+	eng.Timeout = 300 * time.Millisecond
+	eval, err := eng.EvaluatePosition(context.Background(), false, "startpos", nil, SearchLimits{Depth: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eval.BestMove != "e2e4" {
+		t.Errorf("best move is %s, want e2e4", eval.BestMove)
+	}
+}
+
+func TestEvaluatePositionCancel(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+"> go\n< info depth 1 score cp 7 pv d2d4\nwait stop\n< bestmove d2d4\n", nil)
+	defer eng.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	eval, err := eng.EvaluatePosition(ctx, false, "startpos", []string{"e2e4"}, SearchLimits{Depth: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eval.BestMove != "d2d4" {
+		t.Errorf("best move is %s, want d2d4", eval.BestMove)
+	}
+}
+
+func TestGameSession(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+`
+> go
+< info depth 1 score cp 30 pv e2e4 e7e5
+< bestmove e2e4 ponder e7e5
+> go
+< info depth 1 score cp 20 pv b1c3
+< bestmove b1c3
+> go ponder
+< info depth 1 score cp 25 pv g1f3 b8c6
+wait ponderhit|stop
+< bestmove g1f3 ponder b8c6
+`, nil)
+	defer eng.Close()
+	s, err := NewGameSession(eng, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	limits := SearchLimits{MoveTime: 100}
+	for _, c := range []struct {
+		opponent, best string
+	}{
+		{"", "e2e4"},
+		{"e7e5", "g1f3"}, // ponderhit
+		{"g8f6", "b1c3"}, // the ponder search on b8c6 is stopped
+	} {
+		if c.opponent != "" {
+			if err := s.Play(c.opponent); err != nil {
+				t.Fatal(err)
+			}
+		}
+		eval, err := s.Go(context.Background(), limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eval.BestMove != c.best {
+			t.Errorf("best move is %s, want %s", eval.BestMove, c.best)
+		}
+	}
+	want := []string{"e2e4", "e7e5", "g1f3", "g8f6", "b1c3"}
+	if !reflect.DeepEqual(s.Moves(), want) {
+		t.Errorf("moves are %v, want %v", s.Moves(), want)
+	}
+	var perr *PositionError
+	if err := s.Play("e2e4"); !errors.As(err, &perr) || perr.Ply != len(want)+1 {
+		t.Errorf("illegal move gives %v, want a PositionError at ply %d", err, len(want)+1)
+	}
+	if !reflect.DeepEqual(s.Moves(), want) {
+		t.Errorf("moves after an illegal one are %v, want %v", s.Moves(), want)
+	}
+}
+
+// TestStartAnalysisCancelReady cancels a search while the engine is
+// getting ready. The engine must not be restarted and its late readyok
+// must not confuse the next search.
+func TestStartAnalysisCancelReady(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+"> isready\nsleep 300ms\n< readyok\n"+fakeReady+fakeSearch, nil)
+	defer eng.Close()
+	pid := eng.cmd.Process.Pid
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := eng.StartAnalysis(ctx, UCIPosition{FEN: "startpos"}, SearchLimits{Depth: 2}); err != context.DeadlineExceeded {
+		t.Fatalf("error is %v, want %v", err, context.DeadlineExceeded)
+	}
+	if eng.cmd == nil || eng.cmd.Process.Pid != pid {
+		t.Fatal("engine was restarted")
+	}
+	eval, err := eng.EvaluatePosition(context.Background(), false, "startpos", nil, SearchLimits{Depth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eval.BestMove != "e2e4" {
+		t.Errorf("best move is %s, want e2e4", eval.BestMove)
+	}
+	if eng.cmd.Process.Pid != pid {
+		t.Error("engine was restarted")
+	}
+}
+
+func TestPonderHitNotPondering(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+"> go\n< info depth 1 score cp 7 pv d2d4\nwait stop\n< bestmove d2d4\n", nil)
+	defer eng.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := eng.StartAnalysis(ctx, UCIPosition{FEN: "startpos"}, SearchLimits{Depth: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit := make(chan error, 1)
+	go func() { hit <- a.PonderHit() }()
+	select {
+	case err := <-hit:
+		if err == nil {
+			t.Error("ponderhit on a normal search did not fail")
+		}
+	case <-time.After(time.Second):
+		t.Error("ponderhit on a normal search waited for it")
+	}
+	cancel()
+	if eval, err := a.Result(); err != nil || eval.BestMove != "d2d4" {
+		t.Errorf("search ended with %s, %v, want d2d4", eval.BestMove, err)
+	}
+}
+
+func TestSearchLimitsCommand(t *testing.T) {
+	for _, c := range []struct {
+		limits SearchLimits
+		cmd    string
+	}{
+		{SearchLimits{Depth: 10}, "go depth 10"},
+		{SearchLimits{WTime: 0, BTime: 500, BInc: 100}, "go wtime 0 btime 500 binc 100"},
+		{SearchLimits{WTime: 60000, BTime: 60000, MovesToGo: 3}, "go wtime 60000 btime 60000 movestogo 3"},
+		{SearchLimits{Ponder: true, MoveTime: 100}, "go ponder movetime 100"},
+	} {
+		if cmd := c.limits.command(); cmd != c.cmd {
+			t.Errorf("command of %+v is %q, want %q", c.limits, cmd, c.cmd)
+		}
+	}
+}
+
+// TestGameSessionPonderLimits checks that a ponder search is not used when
+// the move it pondered on comes with new limits, since 'ponderhit' cannot
+// give them to the engine.
+func TestGameSessionPonderLimits(t *testing.T) {
+	eng := startFake(t, fakeHandshake+fakeReady+`
+> go
+< bestmove e2e4 ponder e7e5
+> go ponder
+wait ponderhit|stop
+< bestmove g1f3
+> go movetime 200
+< bestmove b1c3
+`, nil)
+	defer eng.Close()
+	s, err := NewGameSession(eng, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Go(context.Background(), SearchLimits{MoveTime: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Play("e7e5"); err != nil {
+		t.Fatal(err)
+	}
+	eval, err := s.Go(context.Background(), SearchLimits{MoveTime: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eval.BestMove != "b1c3" {
+		t.Errorf("best move is %s, want b1c3 of a new search", eval.BestMove)
+	}
+}